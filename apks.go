@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// isAPKSet checks if path is an APK Set (.apks file), as produced by
+// bundletool build-apks.
+func isAPKSet(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".apks")
+}
+
+// openAPKSet opens the APK Set at path input, downloading it first if it's a
+// URL.
+func openAPKSet(ctx context.Context, input string) (*zip.Reader, io.Closer, error) {
+	if !isURL(input) {
+		zr, err := zip.OpenReader(input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", input, err)
+		}
+		return &zr.Reader, zr, nil
+	}
+	tmp, size, err := downloadInput(ctx, input)
+	if err != nil {
+		return nil, nil, err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		tmp.Close()
+		return nil, nil, fmt.Errorf("%s: %s", input, err)
+	}
+	return zr, tmp, nil
+}
+
+// signSetToFile creates at path output a copy of the APK Set at path input,
+// with each .apk found in it (e.g. splits/base-master.apk or
+// standalones/standalone-x86.apk) signed. Other members, like toc.pb, which
+// refers to the .apk files by path, are copied unchanged. On error, the
+// partially written output file is removed. Like with .apk files, input can
+// be an http:// or https:// URL, which is downloaded first.
+func signSetToFile(ctx context.Context, output, input string, cert *x509.Certificate, key crypto.Signer, opts *Options) error {
+	zr, closer, err := openAPKSet(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	inputs, err := listZip(zr)
+	if err != nil {
+		return fmt.Errorf("%s: %s", input, err)
+	}
+
+	return writeFile(output, func(w io.Writer) error {
+		zw := newZipWriter(w, opts.Level)
+		err := zw.SetComment(zr.Comment)
+		if err != nil {
+			return err
+		}
+		signed := 0
+		for _, in := range inputs {
+			if !strings.HasSuffix(strings.ToLower(in.name), ".apk") {
+				fmt.Fprintln(logOutput, "+", in.name)
+				err = opts.copyFile(ctx, zw, in)
+			} else {
+				fmt.Fprintln(logOutput, "*", in.name)
+				err = signSetEntry(ctx, zw, in, cert, key, opts)
+				signed++
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", in.name, err)
+			}
+		}
+		if signed == 0 {
+			return fmt.Errorf("%s: no .apk files found in APK Set", input)
+		}
+		return zw.Close()
+	})
+}
+
+// signSetEntry writes to zw the signed version of in, an .apk stored in an
+// APK Set. As signing needs random access to the .apk, it is first extracted
+// to a temporary file.
+func signSetEntry(ctx context.Context, zw *zip.Writer, in inputFile, cert *x509.Certificate, key crypto.Signer, opts *Options) error {
+	tmp, err := ioutil.TempFile("", "basia-*.apk")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	r, err := in.open()
+	if err != nil {
+		return err
+	}
+	size, err := copyBuffer(tmp, ctxReader{ctx, r}, opts.CopyBuf)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	inputs, comment, err := readZipInput(tmp, size, in.name)
+	if err != nil {
+		return err
+	}
+	// The .apk is already compressed inside
+	fh := opts.inputFileHeader(in)
+	fh.Method = zip.Store
+	w, err := zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	apk := newZipWriter(w, opts.Level)
+	err = apk.SetComment(comment)
+	if err != nil {
+		return err
+	}
+	err = signFilesContext(ctx, apk, inputs, cert, key, opts)
+	if err != nil {
+		return err
+	}
+	return apk.Close()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignSetToFile(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	apk := func() string {
+		return string(testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "classes.dex": "dex"}))
+	}
+	toc := "\x0a\x16splits/base-master.apk"
+	dir := testDir(t, map[string]string{
+		"in.apks": string(testZip(t, map[string]string{
+			"toc.pb":                         toc,
+			"splits/base-master.apk":         apk(),
+			"splits/base-xxhdpi.apk":         apk(),
+			"standalones/standalone-x86.apk": apk(),
+		})),
+		"empty.apks": string(testZip(t, map[string]string{"toc.pb": toc})),
+	})
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "out.apks")
+	err := signSetToFile(context.Background(), output, filepath.Join(dir, "in.apks"), cert, key, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	apks := 0
+	for _, zf := range zr.File {
+		buf, err := readZipFile(zf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(zf.Name, ".apk") {
+			if zf.Name != "toc.pb" || string(buf) != toc {
+				t.Errorf("%s: got %q, want toc.pb copied unchanged", zf.Name, buf)
+			}
+			continue
+		}
+		apks++
+		if zf.Method != zip.Store {
+			t.Errorf("%s: got compression method %d, want stored", zf.Name, zf.Method)
+		}
+		if _, err := verifyAPK(bytes.NewReader(buf), int64(len(buf))); err != nil {
+			t.Errorf("%s: %s", zf.Name, err)
+		}
+	}
+	if apks != 3 {
+		t.Errorf("got %d .apk files in output, want 3", apks)
+	}
+
+	output = filepath.Join(dir, "empty-out.apks")
+	err = signSetToFile(context.Background(), output, filepath.Join(dir, "empty.apks"), cert, key, &opts)
+	if err == nil || !strings.Contains(err.Error(), "no .apk files found") {
+		t.Errorf("got error %v, want no .apk files found", err)
+	}
+	if _, err := ioutil.ReadFile(output); !os.IsNotExist(err) {
+		t.Errorf("output file not removed: %v", err)
+	}
+}
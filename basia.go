@@ -2,190 +2,1176 @@ package main
 
 import (
 	"archive/zip"
+	"compress/flate"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
+	_ "crypto/sha1"   // for crypto.SHA1
+	_ "crypto/sha256" // for crypto.SHA256
+	_ "crypto/sha512" // for crypto.SHA512
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"go.mozilla.org/pkcs7"
 )
 
+// version of basia, to be set at build time with:
+//
+//	go build -ldflags "-X main.version=1.2.3"
+var version = "devel"
+
+var (
+	input    = flag.String("i", "", "path to `directory` containing files to put in an .apk, or to a .zip/.apk file to re-sign (can be an http:// or https:// URL)")
+	output   = flag.String("o", "", "path to `.apk` file to create, or - for stdout")
+	fileList = flag.String("filelist", "", "`file` listing files to put in the .apk instead of -i, one per line, as the path inside the .apk and the source path separated by a tab; entries are stored in listed order, unless -order is given")
+	sigFile  = flag.String("sig", "", "`file` with detached PKCS#7 signature of the .sf file written by prepare command (DER or PEM), for finalize command")
+	outDir   = flag.String("out-dir", "", "`directory` where to create a separate .apk for each subdirectory of -i directory, instead of -o")
+	certfile = flag.String("c", "cert.x509.pem", "certificate for signing (PEM or DER)")
+	keyfile  = flag.String("k", "key.pk8", "private key for signing, in PKCS#8 format (DER or PEM)")
+	profile  = flag.String("profile", "", "JSON `file` with default values of flags, e.g. {\"c\": \"cert.pem\", \"digest\": \"sha256\", \"exclude\": [\"META-INF/*.stamp\"]}; flags given on command line take precedence")
+	pemfile  = flag.String("pem", "", "PEM `file` containing both the certificate and private key for signing, instead of -c and -k")
+	debugKey = flag.Bool("debug-key", false, "sign with a freshly generated, ephemeral RSA key and self-signed 'Android Debug' certificate, instead of -c and -k")
+	level    = flag.Int("level", flate.DefaultCompression, "deflate compression `level`, from 0 (none) to 9 (best), or -1 for default")
+
+	createdBy = flag.String("created-by", "basia "+version, "value of Created-By attribute in MANIFEST.MF; omitted if empty")
+	builtBy   = flag.String("built-by", "Generated-by-ADT", "value of Built-By attribute in MANIFEST.MF; omitted if empty")
+
+	minSdk          = flag.Int("min-sdk", 1, "minimum Android API `level` supported by the .apk; selects digest algorithms (SHA-256 for 18+)")
+	digestName      = flag.String("digest", "", "digest `algorithm` for v1 signature: sha1, sha256 or sha512; by default selected based on -min-sdk")
+	sigDigestName   = flag.String("sig-digest", "", "digest `algorithm` for the PKCS#7 signature of CERT.SF: sha1, sha256 or sha512; by default same as in -digest")
+	entryOrder      = flag.String("order", "android", "`order` of entries in the .apk: 'android' (signature files first, then the rest sorted by name), 'sorted' (all sorted by name), or 'input' (signature files first, then the rest in input order)")
+	eol             = flag.String("eol", "crlf", "line `ending` in MANIFEST.MF and signature files: 'crlf' (as written by jarsigner and apksigner) or 'lf' (preferred by some non-Android JAR toolchains)")
+	creatorOS       = flag.String("creator-os", "", "force the `os` recorded in entries' creator version: 'unix' (with file modes normalized to 0644/0755) or 'fat' (no file modes), for .apk identical regardless of build host")
+	jarIndex        = flag.String("jar-index", "", "regenerate META-INF/INDEX.LIST (not signed), listing packages of the output as a JAR with specified `name`, e.g. lib.jar")
+	signerName      = flag.String("signer-name", "CERT", "`name` of the v1 signature files, e.g. MYKEY for META-INF/MYKEY.SF and META-INF/MYKEY.RSA; letters, digits, '-' and '_'")
+	showProgress    = flag.Bool("progress", false, "show a progress bar on stderr, if it's a terminal")
+	stampComment    = flag.Bool("stamp-comment", false, "set the .zip archive comment to SHA-256 fingerprint of the signing certificate and current time (not covered by the signature)")
+	copyBuf         = flag.Int("copy-buf", defaultCopyBuf, "size in `bytes` of the buffer used when reading and writing file contents")
+	noCompress      = flag.Bool("no-compress", false, "store all entries uncompressed, for faster signing of e.g. debug builds (note: entries are not zipaligned)")
+	replaceManifest = flag.Bool("replace-manifest", false, "discard existing MANIFEST.MF and signature files found in input, and generate them from scratch, instead of keeping attributes from MANIFEST.MF")
+	prevApk         = flag.String("prev", "", "previously signed `.apk`, from which digests of files not listed in -changed are reused instead of recalculated")
+	changedList     = flag.String("changed", "", "`file` listing paths of files changed since -prev .apk, one per line (required with -prev)")
+	strict          = flag.Bool("strict", false, "treat warnings as errors")
+	allowExpired    = flag.Bool("allow-expired", false, "allow signing with a certificate which is expired or not yet valid, e.g. an old debug certificate")
+	verifyAfter     = flag.Bool("verify-after", false, "verify v1 signature of each written .apk, and report an error if it fails")
+	listSigners     = flag.Bool("list-signers", false, "in verify command, print a table with details of each signer of the v1 signature")
+	dumpSigBlock    = flag.Bool("signing-block", false, "in info command, also print contents of the APK Signing Block")
+	symlinks        = flag.String("symlinks", "skip", "what to do with symbolic links found in -i directory: 'skip' them with a warning, 'follow' them and put their targets in .apk, or report an 'error'")
+	flatten         = flag.Bool("flatten", false, "treat -i file as a single entry to put in the .apk/.jar, named after the file, instead of an archive to re-sign")
+	maxFiles        = flag.Int("max-files", 0, "abort if -i directory contains more than `N` files; 0 means no limit")
+	maxSize         = flag.Int64("max-size", 0, "abort if total size of files in -i directory exceeds `bytes`; 0 means no limit")
+	maxManifestSize = flag.Int("max-manifest-size", 0, "fail if MANIFEST.MF would be larger than `bytes`, e.g. to catch .apks too large for older devices; 0 means no limit")
+	ignoreDirs      = stringListFlag("ignore-dir", "`glob` pattern of directories to skip when reading -i directory, matched against their path relative to it, e.g. '.git' or 'build/*' (can be repeated)")
+	signingTime     = flag.String("signing-time", "now", "signing `time` to put in the PKCS#7 signature of CERT.SF: 'now', a fixed time in RFC 3339 format (e.g. 2020-01-01T00:00:00Z), or 'none' to sign without any signed attributes (like apksigner); with 'none' or a fixed time, signing with an RSA key twice gives identical signature files")
+	detached        = flag.Bool("detached", true, "write the PKCS#7 signature of CERT.SF without embedding its content, as required in JAR files; -detached=false is only useful for non-JAR uses")
+	manifestAttrs   = flag.String("manifest-attrs", "", "`file` in JAR manifest format with extra attributes to put in MANIFEST.MF, in the main section and in sections of signed entries (e.g. 'Name: lib/a.class' followed by 'Sealed: true')")
+	tsaURL          = flag.String("tsa", "", "`URL` of an RFC 3161 timestamp authority, to timestamp the PKCS#7 signature of CERT.SF (for JAR verifiers checking signatures after the certificate expires)")
+	mtime           = timeFlag("mtime", "modification `time` to set on all entries, in RFC 3339 format, e.g. 2020-01-01T00:00:00Z; by default entries from input .zip keep their time, and no time is set on others (ZIP date 1979-11-30)")
+	zeroMtime       = flag.Bool("zero-mtime", false, "set no modification time on any entry (ZIP date 1979-11-30), also those from input .zip, for reproducible output")
+	inputHeaders    = stringListFlag("i-header", "HTTP `header` to send when downloading -i from a URL, e.g. 'Authorization: Bearer TOKEN' (can be repeated)")
+	drops           = stringListFlag("drop", "`glob` pattern of files to leave out of the .apk altogether, e.g. 'assets/*.map' (can be repeated); unlike -exclude, they're neither stored nor signed")
+	excludes        = stringListFlag("exclude", "`glob` pattern of files to store in .apk but not sign (can be repeated); note: Android rejects unsigned files outside META-INF/")
+)
+
+const pathManifest = "META-INF/MANIFEST.MF"
+
+// isManifest checks if name is the path of MANIFEST.MF, compared
+// case-insensitively, like Android does.
+func isManifest(name string) bool {
+	return strings.EqualFold(name, pathManifest)
+}
+
+// findManifest returns the MANIFEST.MF entry of zr, or nil if there's none.
+func findManifest(zr *zip.Reader) *zip.File {
+	for _, zf := range zr.File {
+		if isManifest(zf.Name) {
+			return zf
+		}
+	}
+	return nil
+}
+
+// Extensions of the v1 signature files written to the .apk, named after
+// -signer-name (see signerPath).
+const (
+	extSf  = ".SF"
+	extRsa = ".RSA"
+	extEc  = ".EC"
+	extDsa = ".DSA" // never written, as DSA keys aren't supported
+)
+
+// signerPath returns the path of the v1 signature file with extension ext,
+// e.g. META-INF/CERT.SF.
+func (o *Options) signerPath(ext string) string {
+	return "META-INF/" + o.SignerName + ext
+}
+
+// logOutput receives messages about processed files. It's stderr when the
+// .apk is written to stdout, with -o -.
+var logOutput io.Writer = os.Stdout
+
+// Errors returned from signing, which callers can check for with errors.Is.
 var (
-	input    = flag.String("i", "", "path to `directory` containing files to put in an .apk")
-	output   = flag.String("o", "", "path to `.apk` file to create")
-	certfile = flag.String("c", "cert.x509.pem", "certificate for signing")
-	keyfile  = flag.String("k", "key.pk8", "private key for signing, in PKCS#8 format")
+	ErrUnsupportedKey = errors.New("unsupported type of signing key")
+	ErrNoInputFiles   = errors.New("no input files found")
 )
 
+// stringList is a flag.Value collecting all values of a repeated flag.
+type stringList []string
+
+func stringListFlag(name, usage string) *stringList {
+	l := &stringList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *stringList) String() string { return strings.Join(*l, " ") }
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// timeValue is a flag.Value with time in RFC 3339 format, which can be
+// represented in ZIP headers.
+type timeValue struct{ time.Time }
+
+func timeFlag(name, usage string) *timeValue {
+	t := &timeValue{}
+	flag.Var(t, name, usage)
+	return t
+}
+
+func (t *timeValue) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeValue) Set(s string) error {
+	v, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return err
+	}
+	if v.Year() < 1980 || v.Year() > 2107 {
+		return fmt.Errorf("year must be between 1980 and 2107 to fit in ZIP header, got: %d", v.Year())
+	}
+	t.Time = v
+	return nil
+}
+
+const usage = `Usage:
+  basia [build] -i DIR|APK -o APK [flags]  - build a signed .apk from files in DIR (or in an unsigned APK)
+  basia sign -i APK -o APK [flags]         - re-sign an existing unsigned .apk/.zip file
+  basia sign -i APKS -o APKS [flags]       - re-sign each .apk in an APK Set (.apks file from bundletool)
+  basia sign-all [flags] DIR               - re-sign in place all .apk files found in DIR (e.g. split APKs)
+  basia info APK                           - show manifest, signers and signature schemes of an .apk
+  basia strip APK -o APK                   - remove all signatures from an .apk, writing an unsigned .apk
+  basia prepare -i DIR|APK -o APK [flags]  - like build, but without signing: writes an .apk lacking the signature block, and APK.sf to sign elsewhere
+  basia finalize APK -sig P7S -o APK       - add the signature of APK.sf made after prepare, writing the signed .apk
+  basia plan -i DIR|APK [flags]            - show which files would be signed, and which not, without signing
+  basia verify APK [flags]                 - verify the v1 (JAR) signature of an .apk
+
+Flags:
+`
+
 func main() {
-	// TODO: usage info
-	flag.Parse()
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	cmd, args := "build", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	args = parseInterspersed(args)
+	if *profile != "" {
+		check(loadProfile(flag.CommandLine, *profile))
+	}
+	if *level < flate.DefaultCompression || *level > flate.BestCompression {
+		die(fmt.Errorf("-level must be between %d and %d, got: %d", flate.DefaultCompression, flate.BestCompression, *level))
+	}
+	if _, ok := digestNames[*digestName]; *digestName != "" && !ok {
+		die(fmt.Errorf("-digest must be one of: sha1, sha256, sha512; got: %q", *digestName))
+	}
+	if _, ok := digestNames[*sigDigestName]; *sigDigestName != "" && !ok {
+		die(fmt.Errorf("-sig-digest must be one of: sha1, sha256, sha512; got: %q", *sigDigestName))
+	}
+	switch *creatorOS {
+	case "", "unix", "fat":
+	default:
+		die(fmt.Errorf("-creator-os must be one of: unix, fat; got: %q", *creatorOS))
+	}
+	switch *entryOrder {
+	case "android", "sorted", "input":
+	default:
+		die(fmt.Errorf("-order must be one of: android, sorted, input; got: %q", *entryOrder))
+	}
+	switch *eol {
+	case "crlf", "lf":
+	default:
+		die(fmt.Errorf("-eol must be one of: crlf, lf; got: %q", *eol))
+	}
+	switch *symlinks {
+	case "skip", "follow", "error":
+	default:
+		die(fmt.Errorf("-symlinks must be one of: skip, follow, error; got: %q", *symlinks))
+	}
+	switch *signingTime {
+	case "now", "none":
+	default:
+		if _, err := time.Parse(time.RFC3339, *signingTime); err != nil {
+			die(fmt.Errorf("-signing-time must be one of: now, none, or time in RFC 3339 format; got: %q", *signingTime))
+		}
+	}
+	if u, err := url.Parse(*tsaURL); *tsaURL != "" && (err != nil || u.Scheme != "http" && u.Scheme != "https") {
+		die(fmt.Errorf("-tsa must be an http:// or https:// URL, got: %q", *tsaURL))
+	}
+	if !validSignerName(*signerName) {
+		die(fmt.Errorf("-signer-name must be non-empty, and contain only letters, digits, '-' and '_', got: %q", *signerName))
+	}
+	if *copyBuf <= 0 {
+		die(fmt.Errorf("-copy-buf must be positive, got: %d", *copyBuf))
+	}
+	if *maxFiles < 0 || *maxSize < 0 || *maxManifestSize < 0 {
+		die(fmt.Errorf("-max-files, -max-size and -max-manifest-size must not be negative"))
+	}
+	for _, pattern := range *excludes {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			die(fmt.Errorf("-exclude %q: %s", pattern, err))
+		}
+	}
+	for _, pattern := range *drops {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			die(fmt.Errorf("-drop %q: %s", pattern, err))
+		}
+	}
+	for _, pattern := range *ignoreDirs {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			die(fmt.Errorf("-ignore-dir %q: %s", pattern, err))
+		}
+	}
+	for _, h := range *inputHeaders {
+		if i := strings.Index(h, ":"); i <= 0 {
+			die(fmt.Errorf("-i-header must have format 'Name: value', got: %q", h))
+		}
+	}
+	if *fileList != "" {
+		if cmd != "build" && cmd != "plan" && cmd != "prepare" || *input != "" || *outDir != "" || *flatten {
+			die(fmt.Errorf("-filelist requires build, plan or prepare command, and can't be used with -i, -out-dir or -flatten"))
+		}
+		orderSet := false
+		flag.Visit(func(f *flag.Flag) { orderSet = orderSet || f.Name == "order" })
+		if !orderSet {
+			*entryOrder = "input"
+		}
+	}
+
+	opts := flagOptions()
+
+	switch cmd {
+	case "build", "sign":
+	case "sign-all":
+		if len(args) != 1 {
+			die(fmt.Errorf("sign-all: expected exactly one directory argument, got: %q", args))
+		}
+	case "info":
+		if len(args) != 1 {
+			die(fmt.Errorf("info: expected exactly one .apk argument, got: %q", args))
+		}
+		check(printInfo(os.Stdout, args[0]))
+		return
+	case "plan":
+		check(printPlan(os.Stdout, *input, &opts))
+		return
+	case "verify":
+		if len(args) != 1 {
+			die(fmt.Errorf("verify: expected exactly one .apk argument, got: %q", args))
+		}
+		signers, err := verifyFile(args[0])
+		check(err)
+		if *listSigners {
+			check(printSignerTable(os.Stdout, signers))
+			return
+		}
+		for _, s := range signers {
+			fmt.Println("verified, signer SHA-256:", fingerprint(s.cert))
+		}
+		return
+	case "strip":
+		if len(args) != 1 || *output == "" {
+			die(fmt.Errorf("strip: expected exactly one .apk argument and -o, got: %q", args))
+		}
+	case "prepare":
+		if *output == "" || *output == "-" {
+			die(fmt.Errorf("prepare: -o must be a file path"))
+		}
+		if *stampComment || *tsaURL != "" || *verifyAfter {
+			die(fmt.Errorf("prepare: -stamp-comment, -tsa and -verify-after can't be used without signing"))
+		}
+	case "finalize":
+		if len(args) != 1 || *output == "" || *sigFile == "" {
+			die(fmt.Errorf("finalize: expected exactly one .apk argument, -sig and -o, got: %q", args))
+		}
+	default:
+		flag.Usage()
+		die(fmt.Errorf("unknown command: %q", cmd))
+	}
+	if *prevApk != "" && (*changedList == "" || cmd == "sign-all") {
+		die(fmt.Errorf("-prev requires -changed, and can't be used with sign-all"))
+	}
+	if *output == "-" {
+		logOutput = os.Stderr
+		if *verifyAfter {
+			die(fmt.Errorf("-verify-after can't be used with -o -"))
+		}
+	}
+	if *debugKey && *pemfile != "" {
+		die(fmt.Errorf("-debug-key can't be used with -pem"))
+	}
+	if *zeroMtime && !mtime.IsZero() {
+		die(fmt.Errorf("-zero-mtime can't be used with -mtime"))
+	}
+	if *outDir != "" {
+		fi, err := os.Stat(*input)
+		check(err)
+		if cmd != "build" || *output != "" || !fi.IsDir() {
+			die(fmt.Errorf("-out-dir requires build command with -i directory, and no -o"))
+		}
+	}
+	if *flatten {
+		fi, err := os.Stat(*input)
+		check(err)
+		if cmd != "build" && cmd != "plan" || fi.IsDir() {
+			die(fmt.Errorf("-flatten requires build or plan command with -i file"))
+		}
+	}
+	if cmd == "sign" && !isURL(*input) {
+		fi, err := os.Stat(*input)
+		check(err)
+		if fi.IsDir() {
+			die(fmt.Errorf("sign: -i must be an .apk/.zip file, got directory: %s", *input))
+		}
+	}
+	if cmd == "sign" && isAPKSet(*input) && (*verifyAfter || *prevApk != "") {
+		die(fmt.Errorf("sign: -verify-after and -prev can't be used with .apks file"))
+	}
+
+	// Cancel on Ctrl-C, so that we can clean up partially written files
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+
+	if *showProgress {
+		// Only on a terminal, as the bar is redrawn in place
+		if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			opts.Progress = &progressBar{w: os.Stderr}
+		}
+	}
+
+	if cmd == "strip" {
+		check(stripToFile(ctx, *output, args[0], &opts))
+		return
+	}
+	if cmd == "prepare" {
+		check(prepareToFile(ctx, *output, *input, &opts))
+		return
+	}
+	if cmd == "finalize" {
+		check(finalizeToFile(ctx, *output, args[0], *sigFile, &opts))
+		return
+	}
 
-	cert, key, err := loadCertAndKey(*certfile, *keyfile)
+	var (
+		cert   *x509.Certificate
+		key    crypto.Signer
+		source string // where cert comes from, for messages
+		err    error
+	)
+	switch {
+	case *debugKey:
+		cert, key, err = generateDebugKey()
+		source = "debug certificate"
+		if err == nil {
+			fmt.Fprintln(logOutput, "debug certificate SHA-256:", fingerprint(cert))
+		}
+	case *pemfile != "":
+		cert, key, err = loadPEM(*pemfile)
+		source = *pemfile
+	default:
+		cert, key, err = loadCertAndKey(*certfile, *keyfile)
+		source = *certfile
+	}
 	check(err)
+	if err := checkValidity(cert, time.Now()); err != nil && !*allowExpired {
+		if *strict {
+			die(fmt.Errorf("%s: %s (use -allow-expired to sign anyway)", source, err))
+		}
+		warn(fmt.Errorf("%s: %s, signing anyway (use -allow-expired to silence this warning)", source, err))
+	}
+	if *minSdk >= 24 {
+		warn(errors.New("APK Signature Scheme v2 is not supported, only v1 (JAR) signature will be written"))
+	}
+	if *digestName == "sha512" {
+		warn(errors.New("SHA-512 v1 signatures are not accepted by most Android versions, use only if your verifier supports them"))
+	}
+	if _, ok := key.Public().(*ecdsa.PublicKey); ok && *minSdk < 18 {
+		warn(errors.New("ECDSA v1 signatures are only supported since Android 4.3 (API 18), consider using -min-sdk 18"))
+	}
+
+	switch cmd {
+	case "build", "sign":
+		if *outDir != "" {
+			check(signDirs(ctx, *input, *outDir, cert, key, &opts))
+			return
+		}
+		if cmd == "sign" && isAPKSet(*input) {
+			check(signSetToFile(ctx, *output, *input, cert, key, &opts))
+			return
+		}
+		check(signToFile(ctx, *output, *input, cert, key, &opts))
+	case "sign-all":
+		check(signAll(ctx, args[0], cert, key, &opts))
+	}
+}
+
+// flagOptions returns Options set from the command-line flags.
+func flagOptions() Options {
+	return Options{
+		Level:           *level,
+		NoCompress:      *noCompress,
+		MinSdk:          *minSdk,
+		Digest:          *digestName,
+		SigDigest:       *sigDigestName,
+		CreatedBy:       *createdBy,
+		BuiltBy:         *builtBy,
+		Order:           *entryOrder,
+		EOL:             *eol,
+		CreatorOS:       *creatorOS,
+		JarIndex:        *jarIndex,
+		SignerName:      *signerName,
+		StampComment:    *stampComment,
+		CopyBuf:         *copyBuf,
+		ReplaceManifest: *replaceManifest,
+		Strict:          *strict,
+		MaxManifestSize: *maxManifestSize,
+		SigningTime:     *signingTime,
+		ManifestAttrs:   *manifestAttrs,
+		TSA:             *tsaURL,
+		Detached:        *detached,
+		Mtime:           mtime.Time,
+		ZeroMtime:       *zeroMtime,
+		Excludes:        *excludes,
+		Drops:           *drops,
+	}
+}
+
+// parseInterspersed parses flags in args, also when they're placed after
+// positional arguments (e.g. "APK -o APK"), and returns the positional
+// arguments.
+func parseInterspersed(args []string) []string {
+	positional := []string{}
+	for {
+		flag.CommandLine.Parse(args)
+		if flag.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, flag.Arg(0))
+		args = flag.Args()[1:]
+	}
+}
 
+// signToFile creates a signed .apk file at path output, containing files from
+// input, which can be either a directory or a .zip/.apk file. On error, the
+// partially written output file is removed.
+func signToFile(ctx context.Context, output, input string, cert *x509.Certificate, key crypto.Signer, opts *Options) error {
 	// Open output .zip - early, to quickly verify if we have write permissions
-	w, err := os.Create(*output)
-	check(err)
-	defer func() { check(w.Close()) }()
-	zw := zip.NewWriter(w)
-	defer func() { check(zw.Close()) }()
+	err := writeFile(output, func(w io.Writer) error {
+		zw := newZipWriter(w, opts.Level)
+		inputs, comment, closer, err := openInput(ctx, input)
+		if err != nil {
+			return err
+		}
+		defer closer.Close()
+		err = zw.SetComment(comment)
+		if err != nil {
+			return err
+		}
+		if *prevApk != "" {
+			err = reuseDigests(inputs, *prevApk, *changedList, digestAttrs[opts.selectDigest()])
+			if err != nil {
+				return err
+			}
+		}
+		err = signFilesContext(ctx, zw, inputs, cert, key, opts)
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+	if err == nil && *verifyAfter {
+		_, err = verifyFile(output)
+		if err != nil {
+			os.Remove(output)
+			err = fmt.Errorf("verification failed: %s", err)
+		}
+	}
+	return err
+}
+
+// writeFile creates a file at path, and calls write with it. All errors are
+// checked, including when closing the file, and the first one is returned; on
+// error, the partially written file is removed. If path is "-", write is
+// called with stdout.
+func writeFile(path string, write func(w io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// SignAPK signs the .zip/.apk file of specified size read from in, and writes
+// the signed .apk to out, without touching the filesystem, as configured with
+// opts (see DefaultOptions).
+func SignAPK(in io.ReaderAt, size int64, out io.Writer, cert *x509.Certificate, key crypto.Signer, opts Options) error {
+	inputs, comment, err := readZipInput(in, size, "input")
+	if err != nil {
+		return err
+	}
+	zw := newZipWriter(out, opts.Level)
+	err = zw.SetComment(comment)
+	if err != nil {
+		return err
+	}
+	err = signFilesContext(context.Background(), zw, inputs, cert, key, &opts)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
 
-	// Collect names & hashes of files from input directory
-	type file struct{ name, data string }
+// signFiles writes inputs into zw, together with v1 (JAR) signature files
+// built using the provided certificate and private key.
+func signFiles(zw *zip.Writer, inputs []inputFile, cert *x509.Certificate, key crypto.Signer, opts *Options) error {
+	return signFilesContext(context.Background(), zw, inputs, cert, key, opts)
+}
+
+// signFilesContext is like signFiles, but stops early with ctx.Err() when ctx
+// is done. If key is nil, the signature block file (e.g. CERT.RSA) is not
+// written, leaving the output to be finalized later (see prepareToFile).
+func signFilesContext(ctx context.Context, zw *zip.Writer, inputs []inputFile, cert *x509.Certificate, key crypto.Signer, opts *Options) error {
+	h := opts.selectDigest()
+	digestAttr := digestAttrs[h]
+
+	// Collect names & hashes of input files, sorted by name, but remembering
+	// their original order in case it's requested for output
+	byName := make([]int, len(inputs))
+	for i := range byName {
+		byName[i] = i
+	}
+	sort.SliceStable(byName, func(i, j int) bool {
+		return javaLess(inputs[byName[i]].name, inputs[byName[j]].name)
+	})
+	type file struct {
+		name, data string // data is the MANIFEST.MF entry, also needed in CERT.SF
+		input      inputFile
+		index      int // position in inputs
+	}
+	var counter *progressCounter
+	if opts.Progress != nil {
+		counter = &progressCounter{p: opts.Progress}
+		for _, in := range inputs {
+			switch class, _ := opts.classify(in.name); {
+			case class == classSigned && in.digest == "":
+				counter.total += 2 * in.size // hashed and copied
+			case class != classDropped:
+				counter.total += in.size
+			}
+		}
+	}
+	extra, err := readExtraAttributes(opts.ManifestAttrs)
+	if err != nil {
+		return err
+	}
+	for _, err := range opts.lintEntries(inputs) {
+		if opts.Strict {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
 	files := []file{}
-	check(filepath.Walk(*input, func(path string, info os.FileInfo, err error) error {
+	var merged manifest // from MANIFEST.MF found in inputs
+	for _, index := range byName {
+		in := inputs[index]
+		if err := checkName(in.name); err != nil {
+			return err
+		}
+		class, err := opts.classify(in.name)
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
-			return nil
+		if class == classDropped {
+			fmt.Fprintln(logOutput, "-", in.name)
+			continue
 		}
-		relpath, err := filepath.Rel(*input, path)
-		check(err)
-		relpath = filepath.ToSlash(relpath)
-		fmt.Println("#", relpath)
-		switch relpath {
-		case "META-INF/MANIFEST.MF", "meta-inf/manifest.mf":
-			die(fmt.Errorf("modifying existing META-INF/MANIFEST.MF file not yet implemented"))
+		fmt.Fprintln(logOutput, "#", in.name)
+		if counter != nil && in.open != nil {
+			in.open = counter.wrapOpen(in.open)
 		}
-		f, err := os.Open(path)
-		check(err)
-		hash, err := sha1sum(f)
-		check(err)
-		f.Close()
-		files = append(files, file{relpath, base64enc(hash[:])})
-		return nil
-	}))
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].name < files[j].name
-	})
+		if class == classMerged {
+			if merged != nil {
+				return fmt.Errorf("%s: more than one %s in input", in.name, pathManifest)
+			}
+			r, err := in.open()
+			if err != nil {
+				return fmt.Errorf("%s: %s", in.name, err)
+			}
+			merged, err = parseManifest(ctxReader{ctx, r})
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %s", in.name, err)
+			}
+			continue
+		}
+		if class != classSigned {
+			files = append(files, file{name: in.name, input: in, index: index})
+			continue
+		}
+		if in.digest != "" {
+			entry := opts.joinBlock(
+				"Name: "+in.name,
+				digestAttr+": "+in.digest)
+			files = append(files, file{name: in.name, data: entry, input: in, index: index})
+			continue
+		}
+		r, err := in.open()
+		if err != nil {
+			return fmt.Errorf("%s: %s", in.name, err)
+		}
+		entry, err := opts.manifestEntry(in.name, ctxReader{ctx, r}, h)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", in.name, err)
+		}
+		files = append(files, file{name: in.name, data: entry, input: in, index: index})
+	}
+	if len(files) == 0 {
+		// An .apk with nothing but signature files is most probably a
+		// mistake, e.g. a wrong -i path
+		return ErrNoInputFiles
+	}
 
-	// Build MANIFEST.MF
-	manifestMf := joinBlock(
-		"Manifest-Version: 1.0",
-		"Built-By: Generated-by-ADT",
-		"Created-By: Android Gradle 3.3.2")
+	// Add attributes kept from the input MANIFEST.MF, then extra ones,
+	// between the Name and the digest, like jarsigner does, before CERT.SF
+	// digests of the sections are calculated. Sections of entries which are
+	// not signed anymore are dropped.
 	for i, f := range files {
-		if isSpecialIgnored(f.name) {
+		attrs := attributes{}
+		if f.data != "" && len(merged[f.name]) > 1 {
+			for _, attr := range merged[f.name][1:] {
+				if !isDigestAttribute(attr) {
+					attrs = append(attrs, attr)
+				}
+			}
+		}
+		if more, ok := extra[f.name]; ok {
+			if f.data == "" {
+				return fmt.Errorf("%s: %s: can't add attributes to an entry which is not signed", opts.ManifestAttrs, f.name)
+			}
+			for _, attr := range more[1:] {
+				if _, ok := attrs.Get(attr[:strings.Index(attr, ": ")]); ok {
+					return fmt.Errorf("%s: %s: attribute already set in MANIFEST.MF: %q", opts.ManifestAttrs, f.name, attr)
+				}
+				attrs = append(attrs, attr)
+			}
+			delete(extra, f.name)
+		}
+		if len(attrs) == 0 {
 			continue
 		}
-		entry := joinBlock(
-			"Name: "+f.name,
-			// Note: using SHA1 (not SHA256) to support old Android devices (https://stackoverflow.com/a/34875983/98528)
-			"SHA1-Digest: "+f.data)
-		manifestMf += entry
-		files[i].data = entry // will be needed in CERT.SF
+		nameLine := strings.TrimSuffix(opts.joinBlock("Name: "+f.name), opts.lineEnd())
+		files[i].data = nameLine + strings.TrimSuffix(opts.joinBlock(attrs...), opts.lineEnd()) + f.data[len(nameLine):]
+	}
+
+	// Build MANIFEST.MF, keeping the main attributes of the input one
+	mainAttrs := append(attributes{}, merged[""]...)
+	if _, ok := mainAttrs.Get("Manifest-Version"); !ok {
+		mainAttrs = append(attributes{"Manifest-Version: 1.0"}, mainAttrs...)
+	}
+	if _, ok := mainAttrs.Get("Built-By"); !ok && opts.BuiltBy != "" {
+		mainAttrs = append(mainAttrs, "Built-By: "+opts.BuiltBy)
+	}
+	if _, ok := mainAttrs.Get("Created-By"); !ok && opts.CreatedBy != "" {
+		mainAttrs = append(mainAttrs, "Created-By: "+opts.CreatedBy)
+	}
+	for _, attr := range extra[""] {
+		if _, ok := mainAttrs.Get(attr[:strings.Index(attr, ": ")]); ok {
+			return fmt.Errorf("%s: attribute already set in main section of MANIFEST.MF: %q", opts.ManifestAttrs, attr)
+		}
+		mainAttrs = append(mainAttrs, attr)
+	}
+	delete(extra, "")
+	if len(extra) > 0 {
+		missing := []string{}
+		for name := range extra {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("%s: no such entries: %s", opts.ManifestAttrs, strings.Join(missing, ", "))
+	}
+	manifestMain := opts.joinBlock(mainAttrs...)
+	buf := strings.Builder{} // avoid quadratic concatenation for many files
+	buf.WriteString(manifestMain)
+	for _, f := range files {
+		buf.WriteString(f.data) // empty for special and excluded files
+	}
+	manifestMf := buf.String()
+	if opts.MaxManifestSize > 0 && len(manifestMf) > opts.MaxManifestSize {
+		return fmt.Errorf("MANIFEST.MF would be %d bytes, larger than %d bytes (-max-manifest-size)", len(manifestMf), opts.MaxManifestSize)
 	}
 
 	// Build CERT.SF
-	certSf := joinBlock(
+	buf.Reset()
+	buf.WriteString(opts.joinBlock(
 		"Signature-Version: 1.0",
 		"Created-By: 1.0 (Android)",
-		"SHA1-Digest-Manifest: "+base64sha1(manifestMf))
+		digestAttr+"-Manifest: "+base64sum(h, manifestMf),
+		// Digest of the main section, including its terminating empty line,
+		// placed after the whole-manifest digest like in JDK's jarsigner.
+		digestAttr+"-Manifest-Main-Attributes: "+base64sum(h, manifestMain)))
 	for _, f := range files {
-		if isSpecialIgnored(f.name) {
-			continue
+		if f.data == "" {
+			continue // not signed
 		}
-		certSf += joinBlock(
+		buf.WriteString(opts.joinBlock(
 			"Name: "+f.name,
-			"SHA1-Digest: "+base64sha1(f.data))
+			digestAttr+": "+base64sum(h, f.data)))
 	}
+	certSf := buf.String()
 
-	// Calculate CERT.RSA or CERT.EC
-	signed, err := sign([]byte(certSf), cert, key)
-	check(err)
-	signedName := ""
-	switch key.(type) {
-	case *ecdsa.PrivateKey:
-		signedName = "META-INF/CERT.EC"
-	case *rsa.PrivateKey:
-		signedName = "META-INF/CERT.RSA"
-	default:
-		die(fmt.Errorf("TODO: unhandled type of private key: %T", key))
+	// Calculate signature block, e.g. CERT.RSA or CERT.EC
+	sigFiles := []file{
+		{name: pathManifest, data: manifestMf},
+		{name: opts.signerPath(extSf), data: certSf}}
+	if key != nil {
+		signedName, err := opts.signatureBlockPath(key.Public())
+		if err != nil {
+			return err
+		}
+		sigH := h
+		if hh, ok := digestNames[opts.SigDigest]; ok {
+			sigH = hh
+		}
+		signed, err := opts.sign([]byte(certSf), cert, key, sigH)
+		if err != nil {
+			return err
+		}
+		sigFiles = append(sigFiles, file{name: signedName, data: string(signed)})
 	}
 
-	// Write result
-	for _, f := range []file{
-		{"META-INF/MANIFEST.MF", manifestMf},
-		{"META-INF/CERT.SF", certSf},
-		{signedName, string(signed)}} {
-		fmt.Println("+", f.name)
-		fh, err := zw.Create(f.name)
-		check(err)
-		_, err = fh.Write([]byte(f.data))
-		check(err)
+	if opts.StampComment && cert != nil {
+		err := zw.SetComment(fmt.Sprintf("Signed-By-SHA-256: %s\nSigned-At: %s", fingerprint(cert), time.Now().UTC().Format(time.RFC3339)))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write result. Signature files have no input, just data.
+	if opts.Order == "input" {
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].index < files[j].index
+		})
+	}
+	n := len(sigFiles)
+	files = append(sigFiles, files...)
+	if opts.JarIndex != "" {
+		names := []string{}
+		for _, f := range files {
+			names = append(names, f.name)
+		}
+		index := file{name: pathJarIndex, data: buildJarIndex(opts.JarIndex, names)}
+		files = append(files[:n], append([]file{index}, files[n:]...)...)
+	}
+	if opts.Order == "sorted" {
+		sort.SliceStable(files, func(i, j int) bool {
+			return javaLess(files[i].name, files[j].name)
+		})
 	}
 	for _, f := range files {
-		fmt.Println("+", f.name)
-		fh, err := os.Open(filepath.Join(*input, f.name))
-		check(err)
-		fi, err := fh.Stat()
-		check(err)
-		zi, err := zip.FileInfoHeader(fi)
-		check(err)
-		zi.Name = f.name
-		zi.Method = zip.Deflate
-		zi.Modified, zi.ModifiedDate, zi.ModifiedTime = time.Time{}, 0, 0
-		zh, err := zw.CreateHeader(zi)
-		check(err)
-		_, err = io.Copy(zh, fh)
-		check(err)
-		fh.Close()
+		fmt.Fprintln(logOutput, "+", f.name)
+		if f.input.open != nil {
+			err := opts.copyFile(ctx, zw, f.input)
+			if err != nil {
+				return fmt.Errorf("%s: %s", f.name, err)
+			}
+			continue
+		}
+		fh, err := zw.CreateHeader(opts.newFileHeader(f.name, 0))
+		if err != nil {
+			return err
+		}
+		_, err = fh.Write([]byte(f.data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signatureBlockPath returns the path of the v1 signature block file for a
+// signing key with public key pub, e.g. META-INF/CERT.RSA.
+func (o *Options) signatureBlockPath(pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return o.signerPath(extEc), nil
+	case *rsa.PublicKey:
+		return o.signerPath(extRsa), nil
+	}
+	return "", fmt.Errorf("%w: %T", ErrUnsupportedKey, pub)
+}
+
+// copyFile writes contents of f into a new deflated entry in zw.
+func (o *Options) copyFile(ctx context.Context, zw *zip.Writer, f inputFile) error {
+	r, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	zh, err := zw.CreateHeader(o.inputFileHeader(f))
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffer(zh, ctxReader{ctx, r}, o.CopyBuf)
+	return err
+}
+
+var copyBufs sync.Pool
+
+// copyBuffer is like io.Copy, but uses a buffer of specified size, reused
+// across calls.
+func copyBuffer(w io.Writer, r io.Reader, size int) (int64, error) {
+	buf, _ := copyBufs.Get().([]byte)
+	if len(buf) != size {
+		buf = make([]byte, size)
+	}
+	defer copyBufs.Put(buf)
+	return io.CopyBuffer(w, r, buf)
+}
+
+// ctxReader is an io.Reader which fails with ctx.Err() once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(buf []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(buf)
+}
+
+// newFileHeader returns a header for an entry in the output .apk. The mode is
+// zero for generated files, like the signature files.
+func (o *Options) newFileHeader(name string, mode os.FileMode) *zip.FileHeader {
+	fh := &zip.FileHeader{
+		Name:     name,
+		Method:   o.compressionMethod(),
+		Modified: o.Mtime,
+	}
+	switch o.CreatorOS {
+	case "unix":
+		if mode&0111 != 0 {
+			mode = 0755
+		} else {
+			mode = 0644
+		}
+		fh.SetMode(mode)
+	case "fat":
+		// MS-DOS creator and no attributes, as in zero value of FileHeader
+	default:
+		if mode != 0 {
+			fh.SetMode(mode)
+		}
+	}
+	return fh
+}
+
+// inputFileHeader returns a header for the entry of input file f in the output
+// .apk. Unless -mtime or -zero-mtime is set, it keeps the modification time of
+// an entry from input .zip.
+func (o *Options) inputFileHeader(f inputFile) *zip.FileHeader {
+	fh := o.newFileHeader(f.name, f.mode)
+	if o.Mtime.IsZero() && !o.ZeroMtime {
+		fh.Modified, fh.ModifiedTime, fh.ModifiedDate = f.modified, f.modifiedTime, f.modifiedDate
+	}
+	return fh
+}
+
+// compressionMethod returns the method used for all entries written to the
+// output .apk.
+func (o *Options) compressionMethod() uint16 {
+	if o.NoCompress {
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+// newZipWriter returns a zip.Writer which compresses zip.Deflate entries with
+// the specified flate compression level.
+func newZipWriter(w io.Writer, level int) *zip.Writer {
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+	return zw
+}
+
+// loadPEM loads the signing certificate and private key from a single PEM
+// file. If there are more certificates, the first one is used. The key can be
+// in PKCS#8, PKCS#1 (RSA) or SEC 1 (EC) format.
+func loadPEM(path string) (*x509.Certificate, crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		cert *x509.Certificate
+		key  crypto.PrivateKey
+	)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if x509.IsEncryptedPEMBlock(block) {
+			return nil, nil, fmt.Errorf("%s: encrypted PEM blocks currently not supported", path)
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			if cert != nil {
+				continue
+			}
+			cert, err = x509.ParseCertificate(block.Bytes)
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			if key != nil {
+				return nil, nil, fmt.Errorf("%s: more than one private key found", path)
+			}
+			switch block.Type {
+			case "PRIVATE KEY":
+				key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			case "RSA PRIVATE KEY":
+				key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			case "EC PRIVATE KEY":
+				key, err = x509.ParseECPrivateKey(block.Bytes)
+			}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s: %s", path, block.Type, err)
+		}
+	}
+	if cert == nil {
+		return nil, nil, fmt.Errorf("%s: no CERTIFICATE found", path)
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("%s: no PRIVATE KEY found", path)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: %w: %T", path, ErrUnsupportedKey, key)
 	}
+	return cert, signer, nil
 }
 
-func loadCertAndKey(certfile, keyfile string) (*x509.Certificate, crypto.PrivateKey, error) {
-	certPEM, err := ioutil.ReadFile(certfile)
+func loadCertAndKey(certfile, keyfile string) (*x509.Certificate, crypto.Signer, error) {
+	rawCert, err := ioutil.ReadFile(certfile)
 	if err != nil {
 		return nil, nil, err
 	}
-	certBlock, _ := pem.Decode(certPEM)
-	if x509.IsEncryptedPEMBlock(certBlock) {
-		return nil, nil, fmt.Errorf("%s: encrypted certificates currently not supported", certfile)
+	// Both files can be either PEM or raw DER
+	if certBlock, _ := pem.Decode(rawCert); certBlock != nil {
+		if x509.IsEncryptedPEMBlock(certBlock) {
+			return nil, nil, fmt.Errorf("%s: encrypted certificates currently not supported", certfile)
+		}
+		rawCert = certBlock.Bytes
 	}
-	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	cert, err := x509.ParseCertificate(rawCert)
 	if err != nil {
-		return nil, nil, fmt.Errorf("%s: %s", certfile, err)
+		return nil, nil, fmt.Errorf("%s: not a valid PEM or DER certificate: %s", certfile, err)
 	}
 
 	rawKey, err := ioutil.ReadFile(keyfile)
 	if err != nil {
 		return nil, nil, err
 	}
+	if keyBlock, _ := pem.Decode(rawKey); keyBlock != nil {
+		if x509.IsEncryptedPEMBlock(keyBlock) {
+			return nil, nil, fmt.Errorf("%s: encrypted keys currently not supported", keyfile)
+		}
+		rawKey = keyBlock.Bytes
+	}
 	key, err := x509.ParsePKCS8PrivateKey(rawKey)
 	if err != nil {
-		return nil, nil, fmt.Errorf("%s: %s", keyfile, err)
+		return nil, nil, fmt.Errorf("%s: not a valid PEM or DER PKCS#8 private key: %s", keyfile, err)
 		// die(fmt.Errorf("parsing PKCS8: %s: %w", keyfile, err))
 	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: %w: %T", keyfile, ErrUnsupportedKey, key)
+	}
+
+	return cert, signer, nil
+}
+
+// selectDigest returns the hash function to be used in v1 signatures, as
+// specified by Digest, or else based on MinSdk.
+func (o *Options) selectDigest() crypto.Hash {
+	if h, ok := digestNames[o.Digest]; ok {
+		return h
+	}
+	return digestForMinSdk(o.MinSdk)
+}
+
+var digestNames = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha512": crypto.SHA512,
+}
+
+// digestForMinSdk returns the hash function to be used in v1 signatures of an
+// .apk supporting Android API levels from minSdk up.
+func digestForMinSdk(minSdk int) crypto.Hash {
+	// SHA-256 in JAR signatures is only supported since Android 4.3 (API 18),
+	// see also: https://stackoverflow.com/a/34875983/98528
+	if minSdk < 18 {
+		return crypto.SHA1
+	}
+	return crypto.SHA256
+}
+
+// manifestEntry calculates digest of data using hash function h, and returns
+// a MANIFEST.MF section for a file with specified name.
+func (o *Options) manifestEntry(name string, data io.Reader, h crypto.Hash) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	attr, ok := digestAttrs[h]
+	if !ok || !h.Available() {
+		return "", fmt.Errorf("unsupported digest algorithm: %v", h)
+	}
+	sum, err := hashsum(h, data, o.CopyBuf)
+	if err != nil {
+		return "", err
+	}
+	return o.joinBlock(
+		"Name: "+name,
+		attr+": "+base64enc(sum)), nil
+}
+
+// javaLess reports whether a sorts before b in Java's String.compareTo order,
+// as used by jarsigner and apksigner. Java compares UTF-16 code units, which
+// for ASCII names (including ones differing only in case) is the same as Go's
+// byte order; it differs for characters outside the Basic Multilingual Plane,
+// which sort before U+E000 to U+FFFF, as their surrogate pairs start with
+// 0xD800 to 0xDBFF.
+func javaLess(a, b string) bool {
+	for a != "" && b != "" {
+		ra, na := utf8.DecodeRuneInString(a)
+		rb, nb := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			ua, ub := firstUTF16(ra), firstUTF16(rb)
+			if ua != ub {
+				return ua < ub
+			}
+			return ra < rb
+		}
+		a, b = a[na:], b[nb:]
+	}
+	return len(a) < len(b)
+}
+
+// firstUTF16 returns the first UTF-16 code unit of r.
+func firstUTF16(r rune) rune {
+	if r >= 0x10000 {
+		r1, _ := utf16.EncodeRune(r)
+		return r1
+	}
+	return r
+}
+
+// checkName verifies that name can be safely put in a manifest file. Control
+// characters, especially CR and LF, could break the structure of the manifest,
+// or even inject fake entries. Names must also be valid UTF-8, as required in
+// manifests; archive/zip then marks them as such with the EFS flag.
+func checkName(name string) error {
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("%q: file name is not valid UTF-8", name)
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("%q: control characters not allowed in file names", name)
+		}
+	}
+	return nil
+}
 
-	return cert, key, nil
+// digestAttrs maps hash functions to names of JAR manifest digest attributes.
+var digestAttrs = map[crypto.Hash]string{
+	crypto.SHA1:   "SHA1-Digest",
+	crypto.SHA256: "SHA-256-Digest",
+	crypto.SHA512: "SHA-512-Digest",
 }
 
-func joinBlock(lines ...string) (block string) {
+func (o *Options) joinBlock(lines ...string) (block string) {
 	for _, l := range lines {
-		block += wrap70(l) + "\r\n"
+		block += o.wrap70(l) + o.lineEnd()
 	}
-	block += "\r\n"
+	block += o.lineEnd()
 	return
 }
-func wrap70(s string) (wrapped string) {
+func (o *Options) wrap70(s string) (wrapped string) {
 	max := 70
 	for len(s) > max {
-		wrapped += s[:max] + "\r\n "
+		wrapped += s[:max] + o.lineEnd() + " "
 		s = s[max:]
 		max = 69
 	}
@@ -193,10 +1179,74 @@ func wrap70(s string) (wrapped string) {
 	return
 }
 
+// lineEnd returns the line ending used in manifest and signature files, as
+// selected with EOL.
+func (o *Options) lineEnd() string {
+	if o.EOL == "lf" {
+		return "\n"
+	}
+	return "\r\n"
+}
+
+// validSignerName checks if name can be used as name of the v1 signature
+// files. The JAR File Specification allows only letters, digits, '-' and '_'.
+func validSignerName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// fileClass describes how an input file is treated when signing.
+type fileClass int
+
+const (
+	classSigned   fileClass = iota // stored and listed in MANIFEST.MF
+	classSpecial                   // signature related file, stored but not signed
+	classExcluded                  // stored but not signed, because of -exclude
+	classDropped                   // not stored, because of -drop, -replace-manifest or -jar-index
+	classMerged                    // MANIFEST.MF, not stored but merged into the new one
+)
+
+func (c fileClass) String() string {
+	return [...]string{"signed", "special", "excluded", "dropped", "merged"}[c]
+}
+
+// classify returns how the input file with specified name will be treated
+// when signing.
+func (o *Options) classify(name string) (fileClass, error) {
+	switch {
+	case matchAny(o.Drops, name):
+		return classDropped, nil
+	case o.ReplaceManifest && isSpecialIgnored(name):
+		return classDropped, nil
+	case isManifest(name):
+		return classMerged, nil
+	case isSpecialIgnored(name):
+		return classSpecial, nil
+	case isJarIndex(name) && o.JarIndex != "":
+		return classDropped, nil
+	case isJarIndex(name):
+		return classSpecial, nil
+	case matchAny(o.Excludes, name):
+		return classExcluded, nil
+	}
+	return classSigned, nil
+}
+
+// isSpecialIgnored reports whether name is one of the JAR signature related
+// files, which are not themselves signed. Names are compared
+// case-insensitively, like Android does.
 func isSpecialIgnored(name string) bool {
-	if !strings.HasPrefix(name, "META-INF/") {
+	if len(name) < len("META-INF/") || !strings.EqualFold(name[:len("META-INF/")], "META-INF/") {
 		return false // small optimization
 	}
+	name = strings.ToUpper(name)
 	match := func(pattern, name string) bool {
 		m, err := path.Match(pattern, name)
 		if err != nil {
@@ -205,7 +1255,7 @@ func isSpecialIgnored(name string) bool {
 		return m
 	}
 	// https://docs.oracle.com/javase/7/docs/technotes/guides/jar/jar.html#Signed_JAR_File
-	return name == "META-INF/MANIFEST.MF" ||
+	return name == pathManifest ||
 		match("META-INF/*.SF", name) ||
 		match("META-INF/*.RSA", name) ||
 		match("META-INF/*.DSA", name) ||
@@ -213,16 +1263,84 @@ func isSpecialIgnored(name string) bool {
 		match("META-INF/SIG-*", name)
 }
 
-func sign(data []byte, cert *x509.Certificate, privkey crypto.PrivateKey) ([]byte, error) {
+// digestOIDs maps hash functions to PKCS#7 digest algorithm identifiers.
+var digestOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   pkcs7.OIDDigestAlgorithmSHA1,
+	crypto.SHA256: pkcs7.OIDDigestAlgorithmSHA256,
+	crypto.SHA512: pkcs7.OIDDigestAlgorithmSHA512,
+}
+
+// matchAny reports whether name matches any of the glob patterns, e.g. of
+// -exclude or -drop.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if m, _ := path.Match(pattern, name); m {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Options) sign(data []byte, cert *x509.Certificate, privkey crypto.Signer, h crypto.Hash) ([]byte, error) {
 	algo, err := pkcs7.NewSignedData(data)
 	if err != nil {
 		return nil, err
 	}
-	err = algo.AddSigner(cert, privkey, pkcs7.SignerInfoConfig{})
+	oid, ok := digestOIDs[h]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature digest algorithm: %v", h)
+	}
+	algo.SetDigestAlgorithm(oid)
+	withAttrs := false
+	switch privkey.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		// Signed attributes always include the signing time, so they can
+		// be disabled for reproducible builds.
+		withAttrs = o.SigningTime != "none"
+	}
+	if withAttrs {
+		err = algo.AddSigner(cert, privkey, pkcs7.SignerInfoConfig{})
+		if err == nil {
+			t := now()
+			if o.SigningTime != "now" {
+				t, err = time.Parse(time.RFC3339, o.SigningTime)
+			}
+			if err == nil {
+				err = setSigningTime(algo, t, privkey, h)
+			}
+		}
+	} else {
+		// pkcs7 can only build signed attributes for key types it knows,
+		// so for other signers (e.g. backed by an HSM or a cloud KMS) we
+		// sign the content directly, like apksigner does for v1 anyway.
+		var encOID asn1.ObjectIdentifier
+		encOID, err = encryptionOID(privkey.Public(), h)
+		if err != nil {
+			return nil, err
+		}
+		algo.SetEncryptionAlgorithm(encOID)
+		err = algo.SignWithoutAttr(cert, privkey, pkcs7.SignerInfoConfig{})
+	}
 	if err != nil {
 		return nil, err
 	}
-	algo.Detach()
+	if o.TSA != "" {
+		si := &algo.GetSignedData().SignerInfos[0]
+		token, err := timestamp(o.TSA, si.EncryptedDigest, h)
+		if err != nil {
+			return nil, err
+		}
+		err = si.SetUnauthenticatedAttributes([]pkcs7.Attribute{{
+			Type:  oidTimeStampToken,
+			Value: asn1.RawValue{FullBytes: token},
+		}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.Detached {
+		algo.Detach()
+	}
 	signature, err := algo.Finish()
 	if err != nil {
 		return nil, err
@@ -230,22 +1348,98 @@ func sign(data []byte, cert *x509.Certificate, privkey crypto.PrivateKey) ([]byt
 	return signature, err
 }
 
-func base64sha1(s string) string {
-	hash, _ := sha1sum(strings.NewReader(s))
-	return base64enc(hash[:])
+// now returns the current time, used as the signing time; replaced in tests.
+var now = time.Now
+
+// setSigningTime replaces the signing time in signed attributes of the only
+// signer of sd, which pkcs7 always sets to time.Now(), and signs the
+// attributes again with key.
+func setSigningTime(sd *pkcs7.SignedData, t time.Time, key crypto.Signer, h crypto.Hash) error {
+	si := &sd.GetSignedData().SignerInfos[0]
+	value, err := asn1.Marshal(t.UTC())
+	if err != nil {
+		return err
+	}
+	for i := range si.AuthenticatedAttributes {
+		attr := &si.AuthenticatedAttributes[i]
+		if attr.Type.Equal(pkcs7.OIDAttributeSigningTime) {
+			attr.Value = asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: value}
+		}
+	}
+	// Signature is calculated over the DER encoding of the attributes as
+	// a SET OF, like in pkcs7
+	attrs, err := asn1.MarshalWithParams(si.AuthenticatedAttributes, "set")
+	if err != nil {
+		return err
+	}
+	digest := h.New()
+	digest.Write(attrs)
+	si.EncryptedDigest, err = key.Sign(rand.Reader, digest.Sum(nil), h)
+	return err
 }
 
-func sha1sum(r io.Reader) (sum [sha1.Size]byte, err error) {
-	calc := sha1.New()
-	_, err = io.Copy(calc, r)
-	calc.Sum(sum[:0])
-	return
+// encryptionOID returns the OID of the signature algorithm for a public key
+// and digest algorithm h, as used in the PKCS#7 SignerInfo structure.
+func encryptionOID(pub crypto.PublicKey, h crypto.Hash) (asn1.ObjectIdentifier, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return pkcs7.OIDEncryptionAlgorithmRSA, nil
+	case *ecdsa.PublicKey:
+		switch h {
+		case crypto.SHA1:
+			return pkcs7.OIDDigestAlgorithmECDSASHA1, nil
+		case crypto.SHA256:
+			return pkcs7.OIDDigestAlgorithmECDSASHA256, nil
+		case crypto.SHA512:
+			return pkcs7.OIDDigestAlgorithmECDSASHA512, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %T with digest %v", ErrUnsupportedKey, pub, h)
+}
+
+func base64sum(h crypto.Hash, s string) string {
+	calc := h.New()
+	io.WriteString(calc, s)
+	return base64enc(calc.Sum(nil))
+}
+
+// hashsum returns digest of all data read from r, calculated with hash
+// function h, reading into a buffer of bufSize bytes. If reading fails, the
+// returned sum is nil.
+func hashsum(h crypto.Hash, r io.Reader, bufSize int) ([]byte, error) {
+	calc := h.New()
+	_, err := copyBuffer(calc, r, bufSize)
+	if err != nil {
+		return nil, err
+	}
+	return calc.Sum(nil), nil
 }
 
 func base64enc(buf []byte) string {
 	return base64.StdEncoding.EncodeToString(buf)
 }
 
+// checkValidity returns an error if cert is expired or not yet valid at time
+// now. Devices with correct clocks refuse to install .apk files signed with
+// such certificates.
+func checkValidity(cert *x509.Certificate, now time.Time) error {
+	switch {
+	case now.Before(cert.NotBefore):
+		return fmt.Errorf("certificate not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		return fmt.Errorf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// warn prints err as a warning, or exits with it if -strict flag was given.
+func warn(err error) {
+	if *strict {
+		die(err)
+	}
+	fmt.Fprintln(os.Stderr, "warning:", err)
+}
+
 func check(err error) {
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error:", err)
@@ -1,13 +1,41 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	differ "github.com/kylelemons/godebug/diff"
+	"go.mozilla.org/pkcs7"
 )
 
 func TestWrap70(t *testing.T) {
-	got := wrap70("" +
+	opts := DefaultOptions()
+	got := opts.wrap70("" +
 		//234567890
 		".bcdefgh.1.bcdefgh.2.bcdefgh.3.bcdefgh.4.bcdefgh.5.bcdefgh.6.bcdefgh.7" +
 		".bcdefgh.A.bcdefgh.B.bcdefgh.C.bcdefgh.D.bcdefgh.E.bcdefgh.F.bcdefgh.G" +
@@ -20,3 +48,1413 @@ func TestWrap70(t *testing.T) {
 		t.Errorf("bad wrap, diff (-have +want):\n%s", diff)
 	}
 }
+
+func TestJoinBlockLineLength(t *testing.T) {
+	opts := DefaultOptions()
+	lines := []string{
+		"Name: res/" + strings.Repeat("a", 200) + ".png",
+		"SHA-512-Digest: " + strings.Repeat("B", 88),
+		"Short: x",
+	}
+	block := opts.joinBlock(lines...)
+	if !strings.HasSuffix(block, "\r\n\r\n") {
+		t.Fatalf("block not terminated with empty line: %q", block)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(block, "\r\n\r\n"), "\r\n") {
+		// JAR spec: no line may be longer than 72 bytes, including CRLF
+		if len(line)+len("\r\n") > 72 {
+			t.Errorf("line longer than 72 bytes with CRLF: %q", line)
+		}
+	}
+	unwrapped := strings.Replace(block, "\r\n ", "", -1)
+	if want := strings.Join(lines, "\r\n") + "\r\n\r\n"; unwrapped != want {
+		t.Errorf("unwrapped block:\n%q\nwant:\n%q", unwrapped, want)
+	}
+}
+
+func TestNewZipWriterLevel(t *testing.T) {
+	data := bytes.Repeat([]byte("hello basia, hello apk! "), 4096)
+	sizes := map[int]uint64{}
+	for _, level := range []int{0, 1, 9} {
+		buf := bytes.NewBuffer(nil)
+		zw := newZipWriter(buf, level)
+		fh, err := zw.CreateHeader(&zip.FileHeader{Name: "data.txt", Method: zip.Deflate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fh.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[level] = zr.File[0].CompressedSize64
+	}
+	if sizes[0] < uint64(len(data)) {
+		t.Errorf("level 0 compressed to %d bytes, want at least %d (stored)", sizes[0], len(data))
+	}
+	if sizes[9] > sizes[1] {
+		t.Errorf("level 9 size %d larger than level 1 size %d", sizes[9], sizes[1])
+	}
+}
+
+// testCertAndKey generates a throwaway self-signed certificate and key.
+func testCertAndKey(t testing.TB) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "basia test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// signTestZip signs an .apk with entries (see testZip) using a test key, and
+// returns the signed .apk opened for reading.
+func signTestZip(t *testing.T, entries map[string]string) *zip.Reader {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	return signTestAPK(t, testZip(t, entries), cert, key, opts)
+}
+
+// signTestAPK signs the .apk in with SignAPK, checks that the signature
+// verifies, and returns the signed .apk opened for reading.
+func signTestAPK(t *testing.T, in []byte, cert *x509.Certificate, key crypto.Signer, opts Options) *zip.Reader {
+	out := bytes.NewBuffer(nil)
+	err := SignAPK(bytes.NewReader(in), int64(len(in)), out, cert, key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAPK(bytes.NewReader(out.Bytes()), int64(out.Len())); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+// signTestFiles signs inputs with signFiles using a test key, and returns the
+// written .apk opened for reading.
+func signTestFiles(t *testing.T, inputs []inputFile, opts Options) *zip.Reader {
+	cert, key := testCertAndKey(t)
+	out := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(out)
+	if err := signFiles(zw, inputs, cert, key, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+func BenchmarkSignFiles1GB(b *testing.B) {
+	opts := DefaultOptions()
+	const size = 1 << 30
+	cert, key := testCertAndKey(b)
+
+	// Highly compressible, so the synthetic input .zip takes only ~1 MB of RAM
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	fh, err := zw.CreateHeader(&zip.FileHeader{Name: "assets/big.bin", Method: zip.Deflate})
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = io.Copy(fh, io.LimitReader(zeroReader{}, size))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		inputs, err := listZip(zr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		zw := newZipWriter(ioutil.Discard, flate.DefaultCompression)
+		if err := signFiles(zw, inputs, cert, key, &opts); err != nil {
+			b.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSignZip(b *testing.B) {
+	cert, key := testCertAndKey(b)
+	opts := DefaultOptions()
+	for _, bb := range []struct{ n, size int }{{10, 1 << 20}, {1000, 10 << 10}, {10000, 100}} {
+		b.Run(fmt.Sprintf("%dx%d", bb.n, bb.size), func(b *testing.B) {
+			buf := bytes.NewBuffer(nil)
+			zw := zip.NewWriter(buf)
+			data := make([]byte, bb.size)
+			rand.Read(data)
+			for i := 0; i < bb.n; i++ {
+				fh, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("assets/%05d.bin", i), Method: zip.Store})
+				if err != nil {
+					b.Fatal(err)
+				}
+				fh.Write(data)
+			}
+			if err := zw.Close(); err != nil {
+				b.Fatal(err)
+			}
+			in := buf.Bytes()
+
+			b.SetBytes(int64(bb.n * bb.size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := SignAPK(bytes.NewReader(in), int64(len(in)), ioutil.Discard, cert, key, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCopyBuf(b *testing.B) {
+	opts := DefaultOptions()
+	const size = 64 << 20
+	cert, key := testCertAndKey(b)
+	opts.NoCompress = true // so that copying is not dwarfed by compression
+	// Read from an actual file, as the number of read syscalls depends on
+	// the buffer size
+	f, err := ioutil.TempFile("", "basia-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, io.LimitReader(zeroReader{}, size))
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	inputs := []inputFile{{
+		name: "assets/big.bin",
+		open: func() (io.ReadCloser, error) { return os.Open(f.Name()) },
+	}}
+	for _, n := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", n>>10), func(b *testing.B) {
+			opts.CopyBuf = n
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				zw := zip.NewWriter(ioutil.Discard)
+				if err := signFiles(zw, inputs, cert, key, &opts); err != nil {
+					b.Fatal(err)
+				}
+				if err := zw.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(buf []byte) (int, error) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
+
+func TestManifestEntry(t *testing.T) {
+	opts := DefaultOptions()
+	tests := []struct {
+		name, data string
+		h          crypto.Hash
+		want       string
+	}{{
+		"res/a.txt", "hello", crypto.SHA1,
+		"Name: res/a.txt\r\nSHA1-Digest: qvTGHdzF6KLavt4PO0gs2a6pQ00=\r\n\r\n",
+	}, {
+		"res/a.txt", "hello", crypto.SHA256,
+		"Name: res/a.txt\r\nSHA-256-Digest: LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=\r\n\r\n",
+	}, {
+		"res/a.txt", "hello", crypto.SHA512,
+		"Name: res/a.txt\r\nSHA-512-Digest: m3HSJL1i83hdltRq0+o9czGb+8KJDKra4t/3JRlnPKcjI8PZm6XBHX\r\n" +
+			" x6zG4UuMXaDEZjR1wuXDre9G9zvN7AQw==\r\n\r\n",
+	}, {
+		"res/drawable-xxxhdpi/a_very_long_file_name_which_needs_to_be_wrapped.png", "", crypto.SHA1,
+		"Name: res/drawable-xxxhdpi/a_very_long_file_name_which_needs_to_be_wra\r\n" +
+			" pped.png\r\nSHA1-Digest: 2jmj7l5rSw0yVb/vlWAYkK/YBwk=\r\n\r\n",
+	}}
+	for _, tt := range tests {
+		got, err := opts.manifestEntry(tt.name, strings.NewReader(tt.data), tt.h)
+		if err != nil {
+			t.Errorf("manifestEntry(%q, %v): %s", tt.name, tt.h, err)
+			continue
+		}
+		if diff := differ.Diff(got, tt.want); diff != "" {
+			t.Errorf("manifestEntry(%q, %v) diff (-have +want):\n%s", tt.name, tt.h, diff)
+		}
+	}
+	_, err := opts.manifestEntry("a", strings.NewReader(""), crypto.MD5)
+	if err == nil {
+		t.Errorf("manifestEntry with MD5: expected error")
+	}
+}
+
+func TestSignFilesBadCRC(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	fh, err := zw.CreateHeader(&zip.FileHeader{Name: "res/a.txt", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Write([]byte("some precious contents"))
+	zw.Close()
+	data := bytes.Replace(buf.Bytes(), []byte("precious"), []byte("PRECIOUS"), 1)
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, err := listZip(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.NewBuffer(nil)
+	err = signFiles(zip.NewWriter(out), inputs, cert, key, &opts)
+	if err == nil || !strings.Contains(err.Error(), "res/a.txt") || !strings.Contains(err.Error(), zip.ErrChecksum.Error()) {
+		t.Errorf("want checksum error for res/a.txt, got: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("%d bytes written to output despite corrupt input", out.Len())
+	}
+}
+
+func TestSignFilesZip64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping ZIP64 test in short mode")
+	}
+	const n = 0xffff + 10 // over the 16-bit entry count limit
+	cert, key := testCertAndKey(t)
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	for i := 0; i < n; i++ {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("assets/%05d.txt", i), Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(w, i)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, err := listZip(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	zw = zip.NewWriter(out)
+	opts := DefaultOptions()
+	if err := signFiles(zw, inputs, cert, key, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err = zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != n+3 {
+		t.Errorf("got %d entries in output, want %d", len(zr.File), n+3)
+	}
+
+	_, cd, err := findEOCD(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig := binary.LittleEndian.Uint32(out.Bytes()[cd:]); sig != 0x02014b50 {
+		t.Errorf("ZIP64 central directory offset %d points at %08x, not a central directory header", cd, sig)
+	}
+	_, err = computeV2ContentDigest(bytes.NewReader(out.Bytes()), int64(out.Len()), crypto.SHA256)
+	if err == nil {
+		t.Errorf("expected computeV2ContentDigest to reject ZIP64 archive")
+	}
+}
+
+func TestSignFilesContextCanceled(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	inputs := []inputFile{{
+		name: "assets/big.bin",
+		open: func() (io.ReadCloser, error) { return ioutil.NopCloser(zeroReader{}), nil },
+	}}
+	out := bytes.NewBuffer(nil)
+	err := signFilesContext(ctx, zip.NewWriter(out), inputs, cert, key, &opts)
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("want %q error, got: %v", context.Canceled, err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("%d bytes written to output after cancellation", out.Len())
+	}
+}
+
+func TestHashsumReadError(t *testing.T) {
+	opts := DefaultOptions()
+	fail := errors.New("disk on fire")
+	r := io.MultiReader(strings.NewReader("some data"), &errReader{fail})
+	sum, err := hashsum(crypto.SHA1, r, defaultCopyBuf)
+	if err != fail || sum != nil {
+		t.Errorf("hashsum: got (%x, %v), want (nil, %v)", sum, err, fail)
+	}
+	r = io.MultiReader(strings.NewReader("some data"), &errReader{fail})
+	entry, err := opts.manifestEntry("a.txt", r, crypto.SHA1)
+	if err != fail || entry != "" {
+		t.Errorf("manifestEntry: got (%q, %v), want (\"\", %v)", entry, err, fail)
+	}
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// opaqueSigner hides the concrete type of the wrapped key, like a signer backed
+// by an HSM or a cloud KMS would.
+type opaqueSigner struct{ crypto.Signer }
+
+func TestSignOpaqueSigner(t *testing.T) {
+	ecCert, ecKey := testCertAndKey(t)
+	opts := DefaultOptions()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "basia test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &rsaKey.PublicKey, rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaCert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("Signature-Version: 1.0\r\n\r\n")
+	for _, tt := range []struct {
+		cert *x509.Certificate
+		key  crypto.Signer
+	}{{ecCert, ecKey}, {rsaCert, rsaKey}} {
+		for _, h := range []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA512} {
+			signed, err := opts.sign(data, tt.cert, opaqueSigner{tt.key}, h)
+			if err != nil {
+				t.Errorf("%T %v: %s", tt.key, h, err)
+				continue
+			}
+			p7, err := pkcs7.Parse(signed)
+			if err != nil {
+				t.Errorf("%T %v: %s", tt.key, h, err)
+				continue
+			}
+			p7.Content = data
+			if err := p7.Verify(); err != nil {
+				t.Errorf("%T %v: verify: %s", tt.key, h, err)
+			}
+		}
+	}
+}
+
+func TestSignDetached(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	data := []byte("Signature-Version: 1.0\r\n\r\n")
+	for _, d := range []bool{true, false} {
+		opts.Detached = d
+		signed, err := opts.sign(data, cert, key, crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p7, err := pkcs7.Parse(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if embedded := bytes.Contains(signed, data); embedded == d {
+			t.Errorf("Detached=%v: content embedded in signature: %v", d, embedded)
+		}
+		p7.Content = data
+		if err := p7.Verify(); err != nil {
+			t.Errorf("Detached=%v: verify: %s", d, err)
+		}
+	}
+}
+
+func TestSignFilesOrder(t *testing.T) {
+	opts := DefaultOptions()
+	tests := []struct {
+		order string
+		want  []string
+	}{{
+		"android",
+		[]string{"META-INF/MANIFEST.MF", "META-INF/CERT.SF", "META-INF/CERT.EC", "AndroidManifest.xml", "classes.dex", "res/a.txt"},
+	}, {
+		"sorted",
+		[]string{"AndroidManifest.xml", "META-INF/CERT.EC", "META-INF/CERT.SF", "META-INF/MANIFEST.MF", "classes.dex", "res/a.txt"},
+	}, {
+		"input",
+		[]string{"META-INF/MANIFEST.MF", "META-INF/CERT.SF", "META-INF/CERT.EC", "res/a.txt", "AndroidManifest.xml", "classes.dex"},
+	}}
+	for _, tt := range tests {
+		opts.Order = tt.order
+		inputs := []inputFile{}
+		for _, name := range []string{"res/a.txt", "AndroidManifest.xml", "classes.dex"} {
+			inputs = append(inputs, inputFile{
+				name: name,
+				open: func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("x")), nil },
+			})
+		}
+		zr := signTestFiles(t, inputs, opts)
+		got := []string{}
+		for _, f := range zr.File {
+			got = append(got, f.Name)
+		}
+		if diff := differ.Diff(strings.Join(got, "\n"), strings.Join(tt.want, "\n")); diff != "" {
+			t.Errorf("-order %s: central directory diff (-have +want):\n%s", tt.order, diff)
+		}
+	}
+}
+
+func TestJavaLess(t *testing.T) {
+	// Expected order, as given by sorting with Java's String.compareTo
+	want := []string{
+		"A.txt",
+		"B.txt",
+		"a.txt",
+		"a/b.txt",
+		"b.txt",
+		"res/A.png",
+		"res/a.png",
+		"res/a.png.bak",
+		"res/\u00e9.png",
+		"res/\U0001F600.png", // surrogate pair: 0xD83D 0xDE00
+		"res/\U0001F601.png",
+		"res/\uE000.png",
+		"res/\uFF21.png",
+	}
+	got := []string{}
+	for i := len(want) - 1; i >= 0; i-- {
+		got = append(got, want[i])
+	}
+	sort.SliceStable(got, func(i, j int) bool { return javaLess(got[i], got[j]) })
+	if diff := differ.Diff(strings.Join(got, "\n"), strings.Join(want, "\n")); diff != "" {
+		t.Errorf("bad order, diff (-have +want):\n%s", diff)
+	}
+	for _, name := range want {
+		if javaLess(name, name) {
+			t.Errorf("javaLess(%q, %q) = true", name, name)
+		}
+	}
+}
+
+func TestSignFilesCreatedBy(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	out := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(out)
+	inputs := []inputFile{{
+		name: "res/a.txt",
+		open: func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("x")), nil },
+	}}
+	if err := signFiles(zw, inputs, cert, key, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Created-By: basia " + version
+	found := false
+	for _, attr := range m[""] {
+		found = found || attr == want
+	}
+	if !found {
+		t.Errorf("MANIFEST.MF main section %q does not contain %q", m[""], want)
+	}
+}
+
+func TestSignFilesControlChars(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	for _, name := range []string{"res/a.txt\r\nName: res/fake.txt", "res/a\n.txt", "res/\ta.txt"} {
+		inputs := []inputFile{{
+			name: name,
+			open: func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("x")), nil },
+		}}
+		out := bytes.NewBuffer(nil)
+		err := signFiles(zip.NewWriter(out), inputs, cert, key, &opts)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%q", name)) {
+			t.Errorf("%q: want error identifying the name, got: %v", name, err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("%q: %d bytes written to output", name, out.Len())
+		}
+	}
+	_, err := opts.manifestEntry("res/a\r.txt", strings.NewReader(""), crypto.SHA1)
+	if err == nil {
+		t.Errorf("manifestEntry with CR in name: expected error")
+	}
+}
+
+func TestSignFilesDropsAlignmentExtra(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	// Android alignment extra field (0xd935): length 2, alignment 4
+	fh, err := zw.CreateHeader(&zip.FileHeader{Name: "res/raw/a.ogg", Method: zip.Store, Extra: []byte{0x35, 0xd9, 2, 0, 4, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Write([]byte("some audio"))
+	zw.Close()
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, err := listZip(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	zw = zip.NewWriter(out)
+	if err := signFiles(zw, inputs, cert, key, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err = zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if len(f.Extra) != 0 {
+			t.Errorf("%s: got Extra %x, want none", f.Name, f.Extra)
+		}
+	}
+}
+
+func TestIsSpecialIgnored(t *testing.T) {
+	tests := map[string]bool{
+		"META-INF/MANIFEST.MF": true,
+		"meta-inf/manifest.mf": true,
+		"META-INF/CERT.SF":     true,
+		"META-INF/cert.rsa":    true,
+		"Meta-Inf/Cert.Ec":     true,
+		"META-INF/foo.dsa":     true,
+		"meta-inf/sig-foo":     true,
+		"META-INF/services/x":  false,
+		"META-INF/cert.txt":    false,
+		"res/META-INF/CERT.SF": false,
+		"META-INF":             false,
+		"classes.dex":          false,
+	}
+	for name, want := range tests {
+		if got := isSpecialIgnored(name); got != want {
+			t.Errorf("isSpecialIgnored(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSignFilesErrors(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("x")), nil }
+	tests := []struct {
+		inputs []inputFile
+		key    crypto.Signer
+		want   error
+	}{
+		{[]inputFile{{name: "res/a.txt", open: open}}, edKey, ErrUnsupportedKey},
+		{[]inputFile{{name: "res/a.txt", open: open}}, opaqueSigner{edKey}, ErrUnsupportedKey},
+	}
+	for _, tt := range tests {
+		err := signFiles(zip.NewWriter(ioutil.Discard), tt.inputs, cert, tt.key, &opts)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s with %T: got error %v, want %v", tt.inputs[0].name, tt.key, err, tt.want)
+		}
+	}
+
+	// Nothing left to put in .apk besides the signature files
+	opts.ReplaceManifest = true
+	inputs := []inputFile{{name: "META-INF/CERT.SF", open: open}}
+	err = signFiles(zip.NewWriter(ioutil.Discard), inputs, cert, key, &opts)
+	if err != ErrNoInputFiles {
+		t.Errorf("got error %v, want %v", err, ErrNoInputFiles)
+	}
+}
+
+func TestSignFilesMaxManifestSize(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	open := func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("x")), nil }
+	inputs := []inputFile{}
+	for i := 0; i < 100; i++ {
+		inputs = append(inputs, inputFile{name: fmt.Sprintf("res/raw/file%03d.txt", i), open: open})
+	}
+	zr := signTestFiles(t, inputs, opts)
+	size := int(zr.File[0].UncompressedSize64)
+
+	opts.MaxManifestSize = size
+	if err := signFiles(zip.NewWriter(ioutil.Discard), inputs, cert, key, &opts); err != nil {
+		t.Errorf("-max-manifest-size %d: %s", size, err)
+	}
+	opts.MaxManifestSize = size - 1
+	err := signFiles(zip.NewWriter(ioutil.Discard), inputs, cert, key, &opts)
+	want := fmt.Sprintf("MANIFEST.MF would be %d bytes, larger than %d bytes", size, size-1)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("-max-manifest-size %d: got error %v, want %q", size-1, err, want)
+	}
+}
+
+func TestSignAPK(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	zr := signTestZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	m, err := readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SHA1-Digest: qvTGHdzF6KLavt4PO0gs2a6pQ00="
+	if got := m["res/a.txt"]; len(got) != 2 || got[1] != want {
+		t.Errorf("MANIFEST.MF section for res/a.txt: got %q, want %q", got, want)
+	}
+
+	err = SignAPK(strings.NewReader("not a zip"), 9, ioutil.Discard, cert, key, opts)
+	if err == nil {
+		t.Errorf("expected error for invalid input")
+	}
+}
+
+// TestSignAPKSnapshot is a regression snapshot of the exact bytes of
+// MANIFEST.MF and CERT.SF produced by basia for a tiny .apk, to catch
+// unintended changes of the output. The expected bytes were written by basia
+// itself, not by apksigner, so they don't prove interoperability; only the
+// digests were cross-checked with: openssl sha1 -binary | base64
+func TestSignAPKSnapshot(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	opts.CreatedBy = "basia devel"
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello", "classes.dex": ""})
+	zr := signTestAPK(t, in, cert, key, opts)
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantManifest := "" +
+		"Manifest-Version: 1.0\r\n" +
+		"Built-By: Generated-by-ADT\r\n" +
+		"Created-By: basia devel\r\n" +
+		"\r\n" +
+		"Name: AndroidManifest.xml\r\n" +
+		"SHA1-Digest: ICdtDMn/hMhrYRlBW70NBfm9e9c=\r\n" +
+		"\r\n" +
+		"Name: classes.dex\r\n" +
+		"SHA1-Digest: 2jmj7l5rSw0yVb/vlWAYkK/YBwk=\r\n" +
+		"\r\n" +
+		"Name: res/a.txt\r\n" +
+		"SHA1-Digest: qvTGHdzF6KLavt4PO0gs2a6pQ00=\r\n" +
+		"\r\n"
+	if diff := differ.Diff(string(files["META-INF/MANIFEST.MF"]), wantManifest); diff != "" {
+		t.Errorf("bad MANIFEST.MF, diff (-have +want):\n%s", diff)
+	}
+	wantCertSf := "" +
+		"Signature-Version: 1.0\r\n" +
+		"Created-By: 1.0 (Android)\r\n" +
+		"SHA1-Digest-Manifest: pjbhMkX50kdBvFgvFnhgcyjo27I=\r\n" +
+		"SHA1-Digest-Manifest-Main-Attributes: CZ89arVK4mfp2T8kEeLmoRwwDWs=\r\n" +
+		"\r\n" +
+		"Name: AndroidManifest.xml\r\n" +
+		"SHA1-Digest: KV8jERx7dKAYrCGS6pm52AF7tpM=\r\n" +
+		"\r\n" +
+		"Name: classes.dex\r\n" +
+		"SHA1-Digest: vihsvZUvG76S93UkttJUporbFIA=\r\n" +
+		"\r\n" +
+		"Name: res/a.txt\r\n" +
+		"SHA1-Digest: Hfmfu0/LV1Ybme62Gf1K04VsWsI=\r\n" +
+		"\r\n"
+	if diff := differ.Diff(string(files["META-INF/CERT.SF"]), wantCertSf); diff != "" {
+		t.Errorf("bad CERT.SF, diff (-have +want):\n%s", diff)
+	}
+
+	// The signature block differs on each run, so only verify it
+	p7, err := pkcs7.Parse(files["META-INF/CERT.EC"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7.Content = files["META-INF/CERT.SF"]
+	if err := p7.Verify(); err != nil {
+		t.Errorf("CERT.EC: %s", err)
+	}
+}
+
+// TestSignAPKMatchesApksigner compares MANIFEST.MF and CERT.SF byte-for-byte
+// with those written by Google's apksigner for the same input and key, when
+// apksigner is found in PATH (e.g. from Android SDK build-tools).
+func TestSignAPKMatchesApksigner(t *testing.T) {
+	apksigner, err := exec.LookPath("apksigner")
+	if err != nil {
+		t.Skip("apksigner not found in PATH")
+	}
+	cert, key, err := generateDebugKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello", "classes.dex": ""})
+	dir := testDir(t, map[string]string{
+		"in.apk":   string(in),
+		"key.pk8":  string(rawKey),
+		"cert.pem": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+	})
+	defer os.RemoveAll(dir)
+	ref := filepath.Join(dir, "ref.apk")
+	cmd := exec.Command(apksigner, "sign",
+		"--v1-signing-enabled", "true", "--v2-signing-enabled", "false", "--v3-signing-enabled", "false",
+		"--min-sdk-version", "1", "--v1-signer-name", "CERT",
+		"--key", filepath.Join(dir, "key.pk8"), "--cert", filepath.Join(dir, "cert.pem"),
+		"--out", ref, filepath.Join(dir, "in.apk"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("apksigner: %s\n%s", err, out)
+	}
+	refZip, err := zip.OpenReader(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refZip.Close()
+
+	opts := DefaultOptions()
+	opts.CreatedBy = "1.0 (Android)"
+	opts.BuiltBy = ""
+	zr := signTestAPK(t, in, cert, key, opts)
+	for _, name := range []string{pathManifest, "META-INF/CERT.SF"} {
+		got, want := zipFileByName(t, zr, name), zipFileByName(t, &refZip.Reader, name)
+		if diff := differ.Diff(got, want); diff != "" {
+			t.Errorf("%s differs from apksigner's, diff (-basia +apksigner):\n%s", name, diff)
+		}
+	}
+}
+
+// zipFileByName returns contents of the entry with specified name in zr.
+func zipFileByName(t *testing.T, zr *zip.Reader, name string) string {
+	for _, zf := range zr.File {
+		if zf.Name == name {
+			buf, err := readZipFile(zf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(buf)
+		}
+	}
+	t.Fatalf("%s: not found", name)
+	return ""
+}
+
+func TestSignFilesManifestEnd(t *testing.T) {
+	opts := DefaultOptions()
+	open := func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("x")), nil }
+	for _, inputs := range [][]inputFile{
+		{{name: "res/a.txt", open: open}},
+		{{name: "res/a.txt", open: open}, {name: "res/b.txt", open: open}},
+	} {
+		zr := signTestFiles(t, inputs, opts)
+		for _, f := range zr.File[:2] {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Each section ends with an empty line, and the file ends right
+			// after the last one
+			s := string(data)
+			if !strings.HasSuffix(s, "\r\n\r\n") || strings.HasSuffix(s, "\r\n\r\n\r\n") {
+				t.Errorf("%s with %d inputs: bad ending of: %q", f.Name, len(inputs), s)
+			}
+			if n := strings.Count(s, "\r\n\r\n"); n != len(inputs)+1 {
+				t.Errorf("%s with %d inputs: got %d sections, want %d", f.Name, len(inputs), n, len(inputs)+1)
+			}
+		}
+	}
+}
+
+func TestSignAPKEOL(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	opts.EOL = "lf"
+	longName := "res/" + strings.Repeat("a_very_long_file_name_", 5) + ".png"
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", longName: "png"})
+	zr := signTestAPK(t, in, cert, key, opts)
+	for _, f := range zr.File[:2] {
+		data, err := readZipFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := string(data)
+		if strings.Contains(s, "\r") || !strings.HasSuffix(s, "\n\n") || !strings.Contains(s, "\n ") {
+			t.Errorf("%s: want LF line endings and a wrapped line, got: %q", f.Name, s)
+		}
+	}
+	m, err := readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m[longName]; !ok {
+		t.Errorf("wrapped name %s not found in MANIFEST.MF: %v", longName, m)
+	}
+}
+
+func TestSignFilesUTF8Names(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	open := func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("x")), nil }
+	inputs := []inputFile{{name: "assets/café.png", open: open}, {name: "assets/plain.png", open: open}}
+	zr := signTestFiles(t, inputs, opts)
+	const efs = 0x800 // language encoding flag: name is UTF-8
+	for _, f := range zr.File {
+		if f.Name == "assets/café.png" && f.Flags&efs == 0 {
+			t.Errorf("%s: UTF-8 flag not set, flags: %#x", f.Name, f.Flags)
+		}
+	}
+	m, err := readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["assets/caf\xc3\xa9.png"]; !ok {
+		t.Errorf("no UTF-8 encoded section for assets/café.png in MANIFEST.MF, got: %q", m)
+	}
+
+	inputs = []inputFile{{name: "assets/caf\xe9.png", open: open}} // Latin-1
+	err = signFiles(zip.NewWriter(ioutil.Discard), inputs, cert, key, &opts)
+	if err == nil {
+		t.Errorf("expected error for non-UTF-8 name")
+	}
+}
+
+func TestSignFilesSigDigest(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SigDigest = "sha256"
+	open := func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("hello")), nil }
+	zr := signTestFiles(t, []inputFile{{name: "res/a.txt", open: open}}, opts)
+	m, err := readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m["res/a.txt"]; len(got) != 2 || !strings.HasPrefix(got[1], "SHA1-Digest: ") {
+		t.Errorf("want SHA1-Digest content digest in MANIFEST.MF, got: %q", got)
+	}
+	r, err := zr.File[2].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := pkcs7.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p7.Signers[0].DigestAlgorithm.Algorithm; !got.Equal(pkcs7.OIDDigestAlgorithmSHA256) {
+		t.Errorf("%s: got signature digest algorithm %v, want SHA-256 %v", zr.File[2].Name, got, pkcs7.OIDDigestAlgorithmSHA256)
+	}
+}
+
+func TestCheckValidity(t *testing.T) {
+	cert, _ := testCertAndKey(t)
+	now := time.Now()
+	tests := []struct {
+		now  time.Time
+		want string
+	}{
+		{now, ""},
+		{now.Add(-2 * time.Hour), "not valid before"},
+		{now.Add(2 * time.Hour), "expired"},
+	}
+	for _, tt := range tests {
+		err := checkValidity(cert, tt.now)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("at %s: unexpected error: %s", tt.now, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("at %s: want error %q, got: %v", tt.now, tt.want, err)
+		}
+	}
+}
+
+func TestSignAPKComment(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	if _, err := zw.Create("res/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	const comment = "build 1234, branch: main"
+	if err := zw.SetComment(comment); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr := signTestAPK(t, buf.Bytes(), cert, key, opts)
+	if zr.Comment != comment {
+		t.Errorf("got archive comment %q, want %q", zr.Comment, comment)
+	}
+}
+
+func TestSignAPKNoCompress(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	opts.NoCompress = true
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	zr := signTestAPK(t, in, cert, key, opts)
+	for _, f := range zr.File {
+		if f.Method != zip.Store {
+			t.Errorf("%s: got method %d, want Store", f.Name, f.Method)
+		}
+	}
+}
+
+func TestSignAPKMtime(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	want := time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC)
+	opts := DefaultOptions()
+	opts.Mtime = want
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	zr := signTestAPK(t, in, cert, key, opts)
+	for _, f := range zr.File {
+		if !f.Modified.Equal(want) {
+			t.Errorf("%s: got modification time %v, want %v", f.Name, f.Modified, want)
+		}
+	}
+
+	defer func(old timeValue) { *mtime = old }(*mtime)
+	if err := mtime.Set("2020-01-02T03:04:06Z"); err != nil || !mtime.Equal(want) {
+		t.Errorf("-mtime: got %v, %v, want %v", mtime.Time, err, want)
+	}
+	for _, bad := range []string{"2020-01-01", "1970-01-01T00:00:00Z", "2200-01-01T00:00:00Z"} {
+		if err := mtime.Set(bad); err == nil {
+			t.Errorf("-mtime %s: want error", bad)
+		}
+	}
+}
+
+func TestSignAPKKeepsInputMtime(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	extended := time.Date(2021, 5, 6, 7, 8, 10, 0, time.UTC)
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	for _, fh := range []*zip.FileHeader{
+		{Name: "AndroidManifest.xml", Modified: extended},
+		{Name: "res/a.txt", ModifiedDate: 0x52a6, ModifiedTime: 0x3904}, // MS-DOS time only, as written by Android tools
+		{Name: "res/b.txt"},
+	} {
+		if _, err := zw.CreateHeader(fh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	in := buf.Bytes()
+
+	zr := signTestAPK(t, in, cert, key, DefaultOptions())
+	for _, f := range zr.File {
+		switch f.Name {
+		case "AndroidManifest.xml":
+			if !f.Modified.Equal(extended) {
+				t.Errorf("%s: got modification time %v, want %v", f.Name, f.Modified, extended)
+			}
+		case "res/a.txt":
+			if f.ModifiedDate != 0x52a6 || f.ModifiedTime != 0x3904 || len(f.Extra) != 0 {
+				t.Errorf("%s: got MS-DOS date %#x, time %#x, extra %x, want 0x52a6, 0x3904 and no extra", f.Name, f.ModifiedDate, f.ModifiedTime, f.Extra)
+			}
+		default:
+			if f.ModifiedDate != 0 || f.ModifiedTime != 0 || len(f.Extra) != 0 {
+				t.Errorf("%s: got MS-DOS date %#x, time %#x, extra %x, want none", f.Name, f.ModifiedDate, f.ModifiedTime, f.Extra)
+			}
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.ZeroMtime = true
+	zr = signTestAPK(t, in, cert, key, opts)
+	for _, f := range zr.File {
+		if f.ModifiedDate != 0 || f.ModifiedTime != 0 || len(f.Extra) != 0 {
+			t.Errorf("ZeroMtime: %s: got MS-DOS date %#x, time %#x, extra %x, want none", f.Name, f.ModifiedDate, f.ModifiedTime, f.Extra)
+		}
+	}
+}
+
+func TestLoadPEM(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	rawKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rawKey})
+	rawECKey, err := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawECKey})
+
+	dir, err := ioutil.TempDir("", "basia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		data    []byte
+		wantErr string
+	}{
+		{concat(keyPEM, certPEM), ""},
+		{concat(certPEM, ecKeyPEM, certPEM), ""},
+		{concat(certPEM, keyPEM, ecKeyPEM), "more than one private key"},
+		{keyPEM, "no CERTIFICATE"},
+		{certPEM, "no PRIVATE KEY"},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, fmt.Sprint(i, ".pem"))
+		if err := ioutil.WriteFile(path, tt.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		gotCert, gotKey, err := loadPEM(path)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("#%d: unexpected error: %s", i, err)
+		case tt.wantErr == "" && (!gotCert.Equal(cert) || !reflect.DeepEqual(gotKey, key)):
+			t.Errorf("#%d: got different certificate or key", i)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("#%d: want error %q, got: %v", i, tt.wantErr, err)
+		}
+	}
+}
+
+func concat(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+func TestSignAPKWithSigningBlock(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	in = withSigningBlock(t, in, map[uint32][]byte{sigBlockV2ID: lp(testV2Signer(0x0103))})
+	out := bytes.NewBuffer(nil)
+	err := SignAPK(bytes.NewReader(in), int64(len(in)), out, cert, key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 3 || m["res/a.txt"] == nil || m["AndroidManifest.xml"] == nil {
+		t.Errorf("bad MANIFEST.MF contents: %q", m)
+	}
+	_, n, err := findSigningBlock(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil || n != 0 {
+		t.Errorf("got APK Signing Block of length %d (err: %v) in output, want none", n, err)
+	}
+}
+
+func TestSignFilesCreatorOS(t *testing.T) {
+	opts := DefaultOptions()
+	open := func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("x")), nil }
+	tests := []struct {
+		os    string
+		modes map[string]os.FileMode // nil means no mode
+	}{
+		{"unix", map[string]os.FileMode{"META-INF/MANIFEST.MF": 0644, "res/a.txt": 0644, "lib/run.sh": 0755}},
+		{"fat", nil},
+	}
+	for _, tt := range tests {
+		opts.CreatorOS = tt.os
+		inputs := []inputFile{
+			{name: "res/a.txt", mode: 0666, open: open},
+			{name: "lib/run.sh", mode: 0700, open: open},
+		}
+		zr := signTestFiles(t, inputs, opts)
+		for _, f := range zr.File {
+			const creatorUnix = 3
+			switch want, ok := tt.modes[f.Name]; {
+			case tt.modes == nil && (f.CreatorVersion>>8 != 0 || f.ExternalAttrs != 0):
+				t.Errorf("-creator-os %s: %s: got creator %d, attrs %#x, want 0 and 0", tt.os, f.Name, f.CreatorVersion>>8, f.ExternalAttrs)
+			case tt.modes != nil && f.CreatorVersion>>8 != creatorUnix:
+				t.Errorf("-creator-os %s: %s: got creator %d, want %d", tt.os, f.Name, f.CreatorVersion>>8, creatorUnix)
+			case ok && f.Mode() != want:
+				t.Errorf("-creator-os %s: %s: got mode %v, want %v", tt.os, f.Name, f.Mode(), want)
+			}
+		}
+	}
+}
+
+func TestLoadCertAndKeyFormats(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	rawKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "basia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string][]byte{
+		"cert.der": cert.Raw,
+		"cert.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		"key.pk8":  rawKey,
+		"key.pem":  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rawKey}),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, certName := range []string{"cert.der", "cert.pem"} {
+		for _, keyName := range []string{"key.pk8", "key.pem"} {
+			gotCert, gotKey, err := loadCertAndKey(filepath.Join(dir, certName), filepath.Join(dir, keyName))
+			if err != nil {
+				t.Errorf("%s, %s: %s", certName, keyName, err)
+				continue
+			}
+			if !gotCert.Equal(cert) || !reflect.DeepEqual(gotKey, key) {
+				t.Errorf("%s, %s: got different certificate or key", certName, keyName)
+			}
+		}
+	}
+}
+
+func TestLoadCertAndKeyGarbage(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	rawKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "basia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string][]byte{
+		"garbage":  []byte("this is not a certificate\n"),
+		"cert.der": cert.Raw,
+		"key.pk8":  rawKey,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct{ cert, key, want string }{
+		{"garbage", "key.pk8", "garbage: not a valid PEM or DER certificate"},
+		{"cert.der", "garbage", "garbage: not a valid PEM or DER PKCS#8 private key"},
+		{"key.pk8", "key.pk8", "key.pk8: not a valid PEM or DER certificate"},
+	}
+	for _, tt := range tests {
+		_, _, err := loadCertAndKey(filepath.Join(dir, tt.cert), filepath.Join(dir, tt.key))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s, %s: want error %q, got: %v", tt.cert, tt.key, tt.want, err)
+		}
+	}
+}
+
+func TestSignFilesStampComment(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	opts.StampComment = true
+	out := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(out)
+	if err := zw.SetComment("overwritten"); err != nil {
+		t.Fatal(err)
+	}
+	inputs := []inputFile{{
+		name: "res/a.txt",
+		open: func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("x")), nil },
+	}}
+	if err := signFiles(zw, inputs, cert, key, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Signed-By-SHA-256: " + fingerprint(cert) + "\nSigned-At: "
+	if !strings.HasPrefix(zr.Comment, want) {
+		t.Errorf("got comment %q, want prefix %q", zr.Comment, want)
+	}
+}
+
+// failingWriter accepts up to n bytes, then fails with err.
+type failingWriter struct {
+	n   int
+	err error
+}
+
+func (w *failingWriter) Write(buf []byte) (int, error) {
+	if len(buf) > w.n {
+		n := w.n
+		w.n = 0
+		return n, w.err
+	}
+	w.n -= len(buf)
+	return len(buf), nil
+}
+
+func TestSignAPKFailingWriter(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	fail := errors.New("disk full")
+	for _, n := range []int{0, 10, 100, 1000} {
+		err := SignAPK(bytes.NewReader(in), int64(len(in)), &failingWriter{n, fail}, cert, key, opts)
+		if !errors.Is(err, fail) {
+			t.Errorf("failing after %d bytes: got error %v, want %v", n, err, fail)
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.apk")
+
+	fail := errors.New("first error")
+	err = writeFile(path, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return fail
+	})
+	if err != fail {
+		t.Errorf("got error %v, want %v", err, fail)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("partially written file not removed: %v", err)
+	}
+
+	err = writeFile(path, func(w io.Writer) error {
+		_, err := w.Write([]byte("ok"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(path); err != nil || string(buf) != "ok" {
+		t.Errorf("got %q, %v; want \"ok\"", buf, err)
+	}
+}
+
+func TestGenerateDebugKey(t *testing.T) {
+	opts := DefaultOptions()
+	cert, key, err := generateDebugKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "Android Debug" {
+		t.Errorf("got CN=%q, want \"Android Debug\"", cert.Subject.CommonName)
+	}
+	if err := checkValidity(cert, time.Now()); err != nil {
+		t.Error(err)
+	}
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		t.Errorf("not self-signed: %s", err)
+	}
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		t.Errorf("got key %T, want *rsa.PrivateKey", key)
+	}
+
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>"})
+	err = SignAPK(bytes.NewReader(in), int64(len(in)), ioutil.Discard, cert, key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
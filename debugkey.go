@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+)
+
+// generateDebugKey creates an ephemeral RSA key and a self-signed certificate
+// for it, with the same subject as used in the Android debug keystore. They
+// are kept in memory only, so each call yields a different signer.
+func generateDebugKey() (*x509.Certificate, crypto.Signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "Android Debug", Organization: []string{"Android"}, Country: []string{"US"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(30, 0, 0),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// isURL checks if path is an http:// or https:// URL, from which -i should be
+// downloaded.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// downloadInput downloads the file at url into a temporary file, which is
+// removed when closed, and returns it with its size. Headers given with
+// -i-header are sent with the request. Redirects are followed; as usual in
+// net/http, headers like Authorization are not forwarded to other hosts.
+func downloadInput(ctx context.Context, url string) (*tempFile, int64, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	for _, h := range *inputHeaders {
+		i := strings.Index(h, ":")
+		req.Header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	f, err := ioutil.TempFile("", "basia-*.apk")
+	if err != nil {
+		return nil, 0, err
+	}
+	tmp := &tempFile{f}
+	size, err := copyBuffer(f, ctxReader{ctx, resp.Body}, *copyBuf)
+	if err != nil {
+		tmp.Close()
+		return nil, 0, fmt.Errorf("%s: %s", url, err)
+	}
+	return tmp, size, nil
+}
+
+// tempFile is a temporary file, removed when closed.
+type tempFile struct{ *os.File }
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignToFileURL(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	apk := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/unsigned.apk", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "who are you?", http.StatusUnauthorized)
+			return
+		}
+		w.Write(apk)
+	})
+	mux.Handle("/latest.apk", http.RedirectHandler("/unsigned.apk", http.StatusFound))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dir := testDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "signed.apk")
+	defer func(old stringList) { *inputHeaders = old }(*inputHeaders)
+
+	*inputHeaders = nil
+	err := signToFile(context.Background(), output, srv.URL+"/latest.apk", cert, key, &opts)
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("without -i-header: got error %v, want 401 Unauthorized", err)
+	}
+
+	*inputHeaders = stringList{"Authorization: Bearer s3cret"}
+	err = signToFile(context.Background(), output, srv.URL+"/latest.apk", cert, key, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAPK(bytes.NewReader(signed), int64(len(signed))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSignSetToFileURL(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	apks := testZip(t, map[string]string{
+		"toc.pb":                 "toc",
+		"splits/base-master.apk": string(testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>"})),
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(apks)
+	}))
+	defer srv.Close()
+
+	dir := testDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "signed.apks")
+	err := signSetToFile(context.Background(), output, srv.URL+"/app.apks", cert, key, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		if zf.Name != "splits/base-master.apk" {
+			continue
+		}
+		buf, err := readZipFile(zf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyAPK(bytes.NewReader(buf), int64(len(buf))); err != nil {
+			t.Errorf("%s: %s", zf.Name, err)
+		}
+	}
+}
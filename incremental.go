@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// reuseDigests fills in digests of inputs from MANIFEST.MF of the previously
+// signed .apk at prevApk, for all files which are not listed in changedList
+// file. Only digests stored in attribute named digestAttr (e.g. SHA1-Digest)
+// are reused. Files removed since prevApk are not among inputs, so their
+// stale entries are dropped.
+//
+// Note: correctness of the result relies on changedList being complete.
+func reuseDigests(inputs []inputFile, prevApk, changedList, digestAttr string) error {
+	changed, err := readChangedList(changedList)
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.OpenReader(prevApk)
+	if err != nil {
+		return fmt.Errorf("%s: %s", prevApk, err)
+	}
+	defer zr.Close()
+	mf := findManifest(&zr.Reader)
+	if mf == nil {
+		return fmt.Errorf("%s: no META-INF/MANIFEST.MF found", prevApk)
+	}
+	m, err := readManifest(mf)
+	if err != nil {
+		return fmt.Errorf("%s: %s", prevApk, err)
+	}
+
+	reused := 0
+	for i, in := range inputs {
+		if changed[in.name] {
+			continue
+		}
+		if digest, ok := m[in.name].Get(digestAttr); ok {
+			inputs[i].digest = digest
+			reused++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "reusing %d of %d digests from %s\n", reused, len(inputs), prevApk)
+	return nil
+}
+
+// readChangedList reads a set of slash-separated paths, one per line.
+func readChangedList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	changed := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			changed[filepath.ToSlash(line)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return changed, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReuseDigests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prev := filepath.Join(dir, "prev.apk")
+	err = ioutil.WriteFile(prev, testZip(t, map[string]string{
+		"META-INF/MANIFEST.MF": "Manifest-Version: 1.0\r\n\r\n" +
+			"Name: res/a.txt\r\nSHA1-Digest: AAAA\r\n\r\n" +
+			"Name: res/b.txt\r\nSHA1-Digest: BBBB\r\n\r\n" +
+			"Name: res/removed.txt\r\nSHA1-Digest: RRRR\r\n\r\n",
+	}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := filepath.Join(dir, "changed.txt")
+	err = ioutil.WriteFile(changed, []byte("res/b.txt\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := []inputFile{{name: "res/a.txt"}, {name: "res/b.txt"}, {name: "res/new.txt"}}
+	err = reuseDigests(inputs, prev, changed, "SHA1-Digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"AAAA", "", ""}
+	for i, in := range inputs {
+		if in.digest != want[i] {
+			t.Errorf("%s: got digest %q, want %q", in.name, in.digest, want[i])
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// printInfo prints information about v1 manifest, signers, and signature
+// schemes present in the .apk file at path apkPath.
+func printInfo(w io.Writer, apkPath string) error {
+	f, err := os.Open(apkPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return fmt.Errorf("%s: %s", apkPath, err)
+	}
+
+	// v1 (JAR) signature
+	if mf := findManifest(zr); mf != nil {
+		m, err := readManifest(mf)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "MANIFEST.MF: %d entries\n", len(m)-1)
+		for _, attr := range m[""] {
+			fmt.Fprintf(w, "  %s\n", attr)
+		}
+	} else {
+		fmt.Fprintln(w, "MANIFEST.MF: none")
+	}
+	for _, zf := range zr.File {
+		if !isSignatureFile(zf.Name) {
+			continue
+		}
+		sf, err := readManifest(zf)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: %d entries\n", zf.Name, len(sf)-1)
+		for _, attr := range sf[""] {
+			fmt.Fprintf(w, "  %s\n", attr)
+		}
+		for _, block := range signatureBlocks(zr, zf.Name) {
+			err := printSigners(w, block)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// v2+ signatures
+	if *dumpSigBlock {
+		offset, length, err := findSigningBlock(f, fi.Size())
+		if err != nil {
+			return err
+		}
+		if length > 0 {
+			pairs, err := readSigningBlock(f, offset, length)
+			if err != nil {
+				return err
+			}
+			err = printSigningBlock(w, offset, length, pairs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	schemes, err := detectFileSchemes(apkPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "Signature schemes:")
+	fmt.Fprintf(w, "  v1 (JAR):  %v\n", schemes.v1)
+	fmt.Fprintf(w, "  v2:        %v\n", schemes.v2)
+	fmt.Fprintf(w, "  v3:        %v\n", schemes.v3)
+	fmt.Fprintf(w, "  v3.1:      %v\n", schemes.v31)
+	fmt.Fprintf(w, "  v4:        %v\n", schemes.v4)
+	return nil
+}
+
+// printSigningBlock prints ID-value pairs of the APK Signing Block found at
+// offset, with details of signers for known signature schemes.
+func printSigningBlock(w io.Writer, offset, length int64, pairs []sigBlockPair) error {
+	fmt.Fprintf(w, "APK Signing Block: offset %d, length %d\n", offset, length)
+	names := map[uint32]string{
+		sigBlockV2ID:      "v2",
+		sigBlockV3ID:      "v3",
+		sigBlockV31ID:     "v3.1",
+		sigBlockPaddingID: "padding",
+	}
+	for _, p := range pairs {
+		name := names[p.id]
+		if name == "" {
+			name = "unknown"
+		}
+		fmt.Fprintf(w, "  ID 0x%08x (%s): %d bytes\n", p.id, name, len(p.value))
+		if p.id != sigBlockV2ID && p.id != sigBlockV3ID && p.id != sigBlockV31ID {
+			continue
+		}
+		signers, err := parseSignerAlgorithms(p.value)
+		if err != nil {
+			return fmt.Errorf("APK Signing Block: %s: %s", name, err)
+		}
+		fmt.Fprintf(w, "    %d signer(s)\n", len(signers))
+		for i, algos := range signers {
+			for _, id := range algos {
+				algo := sigAlgorithmNames[id]
+				if algo == "" {
+					algo = "unknown"
+				}
+				fmt.Fprintf(w, "    signer #%d: 0x%04x %s\n", i+1, id, algo)
+			}
+		}
+	}
+	return nil
+}
+
+func readManifest(zf *zip.File) (manifest, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", zf.Name, err)
+	}
+	defer r.Close()
+	m, err := parseManifest(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", zf.Name, err)
+	}
+	return m, nil
+}
+
+// printSigners prints details of certificates found in a PKCS#7 signature
+// block file (e.g. META-INF/CERT.RSA).
+func printSigners(w io.Writer, zf *zip.File) error {
+	r, err := zf.Open()
+	if err != nil {
+		return fmt.Errorf("%s: %s", zf.Name, err)
+	}
+	raw, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %s", zf.Name, err)
+	}
+	p7, err := pkcs7.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %s", zf.Name, err)
+	}
+	fmt.Fprintf(w, "%s: %d certificate(s)\n", zf.Name, len(p7.Certificates))
+	for _, cert := range p7.Certificates {
+		fmt.Fprintf(w, "  Subject: %s\n", cert.Subject)
+		fmt.Fprintf(w, "  Issuer:  %s\n", cert.Issuer)
+		fmt.Fprintf(w, "  Valid:   %s to %s\n", cert.NotBefore.UTC().Format("2006-01-02"), cert.NotAfter.UTC().Format("2006-01-02"))
+		fmt.Fprintf(w, "  SHA-256: %s\n", fingerprint(cert))
+	}
+	return nil
+}
+
+// fingerprint returns the SHA-256 fingerprint of cert, formatted like in
+// keytool.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// inputFile is a single file to be put in the output .apk.
+type inputFile struct {
+	name string // slash-separated path inside the .apk
+	mode os.FileMode
+	size int64 // uncompressed size, used only for progress reporting
+	open func() (io.ReadCloser, error)
+
+	// digest, if not empty, is the already known base64-encoded digest of
+	// the file's contents, which doesn't need to be calculated again.
+	digest string
+
+	// modified, modifiedTime and modifiedDate are the modification time of
+	// an entry from input .zip, as in zip.FileHeader; modified is set only
+	// if the entry has an extended timestamp. They are zero for other files.
+	modified                   time.Time
+	modifiedTime, modifiedDate uint16
+}
+
+// listDir collects files found under directory dir, skipping subdirectories
+// matching any of -ignore-dir patterns. Symbolic links are handled according
+// to -symlinks. The walk is aborted if the -max-files or -max-size limit is
+// exceeded.
+func listDir(dir string) ([]inputFile, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &dirLister{
+		root:      dir,
+		files:     []inputFile{},
+		following: map[string]bool{root: true},
+	}
+	err = l.walk(root, "")
+	return l.files, err
+}
+
+// dirLister keeps state of listDir across walks of directories reached via
+// followed symbolic links.
+type dirLister struct {
+	root  string
+	files []inputFile
+	total int64
+
+	// following contains resolved paths of directories currently being
+	// walked, to detect symbolic link loops
+	following map[string]bool
+}
+
+// walk collects files found under directory dir, naming them with prefix
+// prepended to their path relative to dir.
+func (l *dirLister) walk(dir, prefix string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Join(prefix, relpath))
+		if info.IsDir() {
+			if path != dir && isIgnoredDir(name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch *symlinks {
+			case "skip":
+				fmt.Fprintf(os.Stderr, "warning: %s: skipping symbolic link (use -symlinks follow to put its target in .apk)\n", name)
+				return nil
+			case "error":
+				return fmt.Errorf("%s: symbolic links not allowed (see -symlinks)", name)
+			}
+			target, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return err
+			}
+			info, err = os.Stat(target)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if isIgnoredDir(name) {
+					return nil
+				}
+				if l.following[target] {
+					return fmt.Errorf("%s: symbolic link loop, points to: %s", name, target)
+				}
+				l.following[target] = true
+				defer delete(l.following, target)
+				return l.walk(target, name)
+			}
+		}
+		if *maxFiles > 0 && len(l.files) >= *maxFiles {
+			return fmt.Errorf("%s: more than %d files found (-max-files), stopped at: %s", l.root, *maxFiles, name)
+		}
+		l.total += info.Size()
+		if *maxSize > 0 && l.total > *maxSize {
+			return fmt.Errorf("%s: total size of files (%d bytes) exceeds %d bytes (-max-size), stopped at: %s", l.root, l.total, *maxSize, name)
+		}
+		l.files = append(l.files, inputFile{
+			name: name,
+			mode: info.Mode(),
+			size: info.Size(),
+			open: func() (io.ReadCloser, error) { return os.Open(path) },
+		})
+		return nil
+	})
+}
+
+// isIgnoredDir checks if slash-separated relpath of a directory matches any
+// of -ignore-dir patterns.
+func isIgnoredDir(relpath string) bool {
+	for _, pattern := range *ignoreDirs {
+		if ok, _ := path.Match(pattern, relpath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listZip collects files stored in a .zip (or .apk) archive. Backslashes in
+// names, written as path separators by some old Windows tools, are replaced
+// with slashes. Local headers of all entries are checked up front, so that a
+// corrupt archive is reported before any output is written.
+func listZip(zr *zip.Reader) ([]inputFile, error) {
+	files := []inputFile{}
+	for _, f := range zr.File {
+		name := strings.Replace(f.Name, "\\", "/", -1)
+		if f.FileInfo().IsDir() || strings.HasSuffix(name, "/") {
+			continue
+		}
+		if _, err := f.DataOffset(); err != nil {
+			return nil, fmt.Errorf("%s: corrupt entry: %s", f.Name, err)
+		}
+		in := inputFile{
+			name:         name,
+			mode:         f.Mode(),
+			size:         int64(f.UncompressedSize64),
+			open:         f.Open,
+			modifiedTime: f.ModifiedTime,
+			modifiedDate: f.ModifiedDate,
+		}
+		if hasExtendedTimestamp(f.Extra) {
+			in.modified = f.Modified
+		}
+		files = append(files, in)
+	}
+	return files, nil
+}
+
+// extTimeExtraID is the ID of the extended timestamp extra field, holding
+// modification time in Unix format.
+const extTimeExtraID = 0x5455
+
+// hasExtendedTimestamp checks if extra fields of a .zip entry include an
+// extended timestamp. Without it, zip.Writer would add one for a non-zero
+// zip.FileHeader.Modified, so only the MS-DOS date and time are copied.
+func hasExtendedTimestamp(extra []byte) bool {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if id == extTimeExtraID {
+			return true
+		}
+		if len(extra) < 4+size {
+			break
+		}
+		extra = extra[4+size:]
+	}
+	return false
+}
+
+// readFileList collects files listed in the file at path, in listed order.
+// Each line has the slash-separated path inside the .apk and the path of the
+// source file, separated by a tab; empty lines are skipped. All source files
+// are checked up front, so that a missing one is reported before any output
+// is written.
+func readFileList(path string) ([]inputFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	files := []inputFile{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected archive path and source path separated by a tab, got: %q", path, n, line)
+		}
+		name, src := fields[0], fields[1]
+		if seen[name] {
+			return nil, fmt.Errorf("%s:%d: %s: listed more than once", path, n, name)
+		}
+		seen[name] = true
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		if fi.IsDir() {
+			return nil, fmt.Errorf("%s:%d: %s: is a directory", path, n, src)
+		}
+		files = append(files, inputFile{
+			name: name,
+			mode: fi.Mode(),
+			size: fi.Size(),
+			open: func() (io.ReadCloser, error) { return os.Open(src) },
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return files, nil
+}
+
+// openInput lists files from path, which can be either a directory, or a
+// .zip/.apk file, possibly at an http(s):// URL, from which it's downloaded.
+// For a .zip/.apk file, the archive comment is also returned. With -flatten, a
+// file is instead returned as the only entry. With -filelist, files listed in
+// it are returned, and path is ignored. The returned io.Closer must be closed
+// after the files are no longer needed.
+func openInput(ctx context.Context, path string) ([]inputFile, string, io.Closer, error) {
+	if *fileList != "" {
+		files, err := readFileList(*fileList)
+		return files, "", nopCloser{}, err
+	}
+	if isURL(path) {
+		f, size, err := downloadInput(ctx, path)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		files, comment, err := readZipInput(f, size, path)
+		if err != nil {
+			f.Close()
+			return nil, "", nil, err
+		}
+		return files, comment, f, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if fi.IsDir() {
+		files, err := listDir(path)
+		return files, "", nopCloser{}, err
+	}
+	if *flatten {
+		return []inputFile{{
+			name: fi.Name(),
+			mode: fi.Mode(),
+			size: fi.Size(),
+			open: func() (io.ReadCloser, error) { return os.Open(path) },
+		}}, "", nopCloser{}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	files, comment, err := readZipInput(f, fi.Size(), path)
+	if err != nil {
+		f.Close()
+		return nil, "", nil, err
+	}
+	return files, comment, f, nil
+}
+
+// readZipInput lists files from a .zip/.apk file of specified size, read from
+// r, and returns them together with the archive comment. The path is only
+// used in messages.
+func readZipInput(r io.ReaderAt, size int64, path string) ([]inputFile, string, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: not a directory nor a valid .zip/.apk file: %s", path, err)
+	}
+	_, n, err := findSigningBlock(r, size)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %s", path, err)
+	}
+	if n > 0 {
+		// We always write a fresh archive, so the old block is dropped; the
+		// output will only have a v1 (JAR) signature.
+		fmt.Fprintf(os.Stderr, "warning: %s: dropping existing APK Signing Block (v2+ signature), output will be signed with v1 scheme only\n", path)
+	}
+	files, err := listZip(zr)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %s", path, err)
+	}
+	return files, zr.Comment, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
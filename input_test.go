@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestListDirIgnoreDir(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"AndroidManifest.xml":     "x",
+		".git/config":             "x",
+		"build/intermediates/x.o": "x",
+		"build/outputs/y":         "x",
+		"res/.git/z":              "x",
+		"res/a.txt":               "x",
+	})
+	defer os.RemoveAll(dir)
+	defer func(old stringList) { *ignoreDirs = old }(*ignoreDirs)
+	*ignoreDirs = stringList{".git", "build/inter*"}
+
+	files, err := listDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, f := range files {
+		got = append(got, f.name)
+	}
+	sort.Strings(got)
+	want := []string{"AndroidManifest.xml", "build/outputs/y", "res/.git/z", "res/a.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+}
+
+func TestListDirLimits(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"a.txt": "12345",
+		"b.txt": "12345",
+		"c.txt": "12345",
+	})
+	defer os.RemoveAll(dir)
+	defer func(files int, size int64) { *maxFiles, *maxSize = files, size }(*maxFiles, *maxSize)
+
+	tests := []struct {
+		files   int
+		size    int64
+		wantErr string
+	}{
+		{0, 0, ""},
+		{3, 15, ""},
+		{2, 0, "more than 2 files found (-max-files), stopped at: c.txt"},
+		{0, 14, "total size of files (15 bytes) exceeds 14 bytes (-max-size), stopped at: c.txt"},
+		{0, 9, "total size of files (10 bytes) exceeds 9 bytes (-max-size), stopped at: b.txt"},
+	}
+	for _, tt := range tests {
+		*maxFiles, *maxSize = tt.files, tt.size
+		_, err := listDir(dir)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.HasSuffix(err.Error(), tt.wantErr)) {
+			t.Errorf("-max-files %d -max-size %d: got error %v, want %q", tt.files, tt.size, err, tt.wantErr)
+		}
+	}
+}
+
+// testDir creates a temporary directory with files of specified contents,
+// keyed by slash-separated paths. The caller must remove the directory.
+func testDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "basia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestOpenInputFlatten(t *testing.T) {
+	dir := testDir(t, map[string]string{"lib.jar": "not really a zip"})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lib.jar")
+
+	_, _, _, err := openInput(context.Background(), path)
+	if err == nil {
+		t.Errorf("want error for non-zip input without -flatten")
+	}
+
+	defer func(old bool) { *flatten = old }(*flatten)
+	*flatten = true
+	files, _, closer, err := openInput(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	if len(files) != 1 || files[0].name != "lib.jar" {
+		t.Fatalf("got files %v, want single lib.jar", files)
+	}
+	r, err := files[0].open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	buf, err := ioutil.ReadAll(r)
+	if err != nil || string(buf) != "not really a zip" {
+		t.Errorf("got contents %q, %v", buf, err)
+	}
+}
+
+func TestReadFileList(t *testing.T) {
+	dir := testDir(t, map[string]string{"out/classes.dex": "dex", "src/Main.xml": "<manifest/>"})
+	defer os.RemoveAll(dir)
+	list := func(lines ...string) string {
+		path := filepath.Join(dir, "list.txt")
+		if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	dex, xml := filepath.Join(dir, "out", "classes.dex"), filepath.Join(dir, "src", "Main.xml")
+
+	files, err := readFileList(list("classes.dex\t"+dex, "", "AndroidManifest.xml\t"+xml+"\r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, f := range files {
+		got = append(got, f.name)
+	}
+	if want := []string{"classes.dex", "AndroidManifest.xml"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %q, want %q in listed order", got, want)
+	}
+	r, err := files[1].open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	buf, err := ioutil.ReadAll(r)
+	if err != nil || string(buf) != "<manifest/>" {
+		t.Errorf("got contents %q, %v", buf, err)
+	}
+
+	for _, tt := range []struct {
+		lines   []string
+		wantErr string
+	}{
+		{[]string{"classes.dex " + dex}, "list.txt:1: expected archive path and source path"},
+		{[]string{"a.dex\t" + dex, "a.dex\t" + xml}, "list.txt:2: a.dex: listed more than once"},
+		{[]string{"missing.txt\t" + filepath.Join(dir, "missing.txt")}, "list.txt:1:"},
+		{[]string{"out\t" + filepath.Join(dir, "out")}, "is a directory"},
+	} {
+		_, err := readFileList(list(tt.lines...))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: got error %v, want %q", tt.lines, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSignToFileEmptyDir(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	dir := testDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "..", filepath.Base(dir)+".apk")
+	defer os.Remove(output)
+
+	err := signToFile(context.Background(), output, dir, cert, key, &opts)
+	if !errors.Is(err, ErrNoInputFiles) {
+		t.Errorf("got error %v, want %v", err, ErrNoInputFiles)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("output file not removed: %v", err)
+	}
+}
+
+func TestSignAPKBackslashNames(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	in := testZip(t, map[string]string{
+		"AndroidManifest.xml": "<manifest/>",
+		"res\\raw\\a.txt":     "hello",
+		"assets\\":            "",
+	})
+	zr := signTestAPK(t, in, cert, key, opts)
+	got := []string{}
+	for _, zf := range zr.File {
+		got = append(got, zf.Name)
+	}
+	want := []string{"META-INF/MANIFEST.MF", "META-INF/CERT.SF", "META-INF/CERT.EC", "AndroidManifest.xml", "res/raw/a.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %q, want %q", got, want)
+	}
+	m, err := readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["res/raw/a.txt"]; !ok {
+		t.Errorf("no section for res/raw/a.txt in MANIFEST.MF, got: %q", m)
+	}
+}
+
+func TestListDirSymlinks(t *testing.T) {
+	outside := testDir(t, map[string]string{"secret.txt": "x", "lib/b.so": "x"})
+	defer os.RemoveAll(outside)
+	dir := testDir(t, map[string]string{"a.txt": "x", "res/c.txt": "x"})
+	defer os.RemoveAll(dir)
+	for link, target := range map[string]string{
+		"res/secret.txt": filepath.Join(outside, "secret.txt"),
+		"lib":            filepath.Join(outside, "lib"),
+		"res/self":       dir,
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(link))); err != nil {
+			t.Skip("cannot create symbolic links:", err)
+		}
+	}
+	defer func(old string) { *symlinks = old }(*symlinks)
+	defer func(old stringList) { *ignoreDirs = old }(*ignoreDirs)
+
+	tests := []struct {
+		symlinks   string
+		ignoreDirs stringList
+		want       []string
+		wantErr    string
+	}{
+		{"skip", nil, []string{"a.txt", "res/c.txt"}, ""},
+		{"error", nil, nil, "lib: symbolic links not allowed (see -symlinks)"},
+		{"follow", nil, nil, "res/self: symbolic link loop"},
+		{"follow", stringList{"res/self"}, []string{"a.txt", "lib/b.so", "res/c.txt", "res/secret.txt"}, ""},
+	}
+	for _, tt := range tests {
+		*symlinks, *ignoreDirs = tt.symlinks, tt.ignoreDirs
+		files, err := listDir(dir)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("-symlinks %s: got error %v, want %q", tt.symlinks, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("-symlinks %s: %s", tt.symlinks, err)
+		}
+		got := []string{}
+		for _, f := range files {
+			got = append(got, f.name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-symlinks %s: got files %q, want %q", tt.symlinks, got, tt.want)
+		}
+	}
+}
+
+func TestSignToFileCorruptZip(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	in := testZip(t, map[string]string{"res/a.txt": "hello"})
+	// Break the signature of the only local file header
+	if !bytes.HasPrefix(in, []byte("PK\x03\x04")) {
+		t.Fatalf("unexpected start of .zip: %q", in[:4])
+	}
+	in[3] = 0xff
+	dir := testDir(t, map[string]string{"in.apk": string(in)})
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out.apk")
+
+	err := signToFile(context.Background(), output, filepath.Join(dir, "in.apk"), cert, key, &opts)
+	if err == nil || !strings.Contains(err.Error(), "in.apk: res/a.txt: corrupt entry: zip: not a valid zip file") {
+		t.Errorf("got error %v, want corrupt entry res/a.txt", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("output left after error: %v", err)
+	}
+	out := bytes.NewBuffer(nil)
+	err = SignAPK(bytes.NewReader(in), int64(len(in)), out, cert, key, opts)
+	if err == nil || out.Len() != 0 {
+		t.Errorf("SignAPK: got error %v and %d bytes of output, want error and no output", err, out.Len())
+	}
+}
+
+func TestSignAPKDrop(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	opts.Drops = []string{"assets/*.map", "META-INF/*.stamp"}
+	in := testZip(t, map[string]string{
+		"AndroidManifest.xml":  "<manifest/>",
+		"assets/app.js":        "js",
+		"assets/app.js.map":    "map",
+		"META-INF/build.stamp": "1",
+	})
+	zr := signTestAPK(t, in, cert, key, opts)
+	for _, zf := range zr.File {
+		if zf.Name == "assets/app.js.map" || zf.Name == "META-INF/build.stamp" {
+			t.Errorf("%s: dropped file was stored", zf.Name)
+		}
+		if zf.Name != pathManifest {
+			continue
+		}
+		manifest, err := readZipFile(zf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(manifest, []byte("app.js.map")) || !bytes.Contains(manifest, []byte("Name: assets/app.js")) {
+			t.Errorf("got MANIFEST.MF:\n%s\nwant assets/app.js, and no dropped file", manifest)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+const pathJarIndex = "META-INF/INDEX.LIST"
+
+// isJarIndex reports whether name is the JAR index file, which is not
+// signed. It's not one of isSpecialIgnored files, so that it's kept when
+// stripping signatures, or with -replace-manifest.
+func isJarIndex(name string) bool {
+	return strings.EqualFold(name, pathJarIndex)
+}
+
+// buildJarIndex returns contents of META-INF/INDEX.LIST for a JAR file named
+// jarName, with entries named as in names, in the same format as written by
+// "jar -i". Each package (directory) containing files is listed once, as are
+// files in the root directory.
+func buildJarIndex(jarName string, names []string) string {
+	buf := strings.Builder{}
+	buf.WriteString("JarIndex-Version: 1.0\n\n")
+	buf.WriteString(jarName + "\n")
+	seen := map[string]bool{}
+	for _, name := range names {
+		if isManifest(name) || isJarIndex(name) || isSpecialIgnored(name) ||
+			strings.HasPrefix(name, "META-INF/versions/") {
+			continue
+		}
+		pkg := path.Dir(name)
+		if pkg == "." {
+			pkg = name
+		}
+		if !seen[pkg] {
+			seen[pkg] = true
+			buf.WriteString(pkg + "\n")
+		}
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	differ "github.com/kylelemons/godebug/diff"
+)
+
+func TestBuildJarIndex(t *testing.T) {
+	got := buildJarIndex("lib.jar", []string{
+		"META-INF/MANIFEST.MF",
+		"META-INF/CERT.SF",
+		"META-INF/INDEX.LIST",
+		"META-INF/services/a.B",
+		"META-INF/versions/9/a/C.class",
+		"a/B.class",
+		"a/C.class",
+		"a/b/D.class",
+		"top.properties",
+	})
+	want := "JarIndex-Version: 1.0\n" +
+		"\n" +
+		"lib.jar\n" +
+		"META-INF/services\n" +
+		"a\n" +
+		"a/b\n" +
+		"top.properties\n" +
+		"\n"
+	if diff := differ.Diff(got, want); diff != "" {
+		t.Errorf("bad INDEX.LIST, diff (-have +want):\n%s", diff)
+	}
+}
+
+func TestSignAPKJarIndex(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	in := testZip(t, map[string]string{
+		"META-INF/INDEX.LIST": "JarIndex-Version: 1.0\n\nold.jar\nold\n\n",
+		"a/B.class":           "x",
+	})
+
+	for _, tt := range []struct {
+		jarIndex, want string
+	}{
+		{"", "JarIndex-Version: 1.0\n\nold.jar\nold\n\n"},
+		{"new.jar", "JarIndex-Version: 1.0\n\nnew.jar\na\n\n"},
+	} {
+		opts.JarIndex = tt.jarIndex
+		zr := signTestAPK(t, in, cert, key, opts)
+		var index []byte
+		for _, zf := range zr.File {
+			if zf.Name == "META-INF/INDEX.LIST" {
+				buf, err := readZipFile(zf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				index = buf
+			}
+		}
+		if string(index) != tt.want {
+			t.Errorf("-jar-index %q: got INDEX.LIST %q, want %q", tt.jarIndex, index, tt.want)
+		}
+		m, err := readManifest(zr.File[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m["META-INF/INDEX.LIST"]; ok {
+			t.Errorf("-jar-index %q: INDEX.LIST listed in MANIFEST.MF", tt.jarIndex)
+		}
+	}
+}
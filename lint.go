@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lintEntries checks inputs for entries which can be signed fine, but make
+// Android reject the .apk on installation, and returns the problems found,
+// in order of inputs. Inputs not stored when signing are not checked.
+func (o *Options) lintEntries(inputs []inputFile) []error {
+	problems := []error{}
+	seen := map[string]bool{
+		pathManifest:        true,
+		o.signerPath(extSf): true,
+	}
+	for _, in := range inputs {
+		class, err := o.classify(in.name)
+		if err != nil || class == classDropped || class == classMerged {
+			continue // errors are reported when signing
+		}
+		name := in.name
+		switch {
+		case strings.HasPrefix(name, "/"):
+			problems = append(problems, fmt.Errorf("%s: absolute paths are rejected by Android", name))
+		case strings.Contains(name, "\\"):
+			problems = append(problems, fmt.Errorf("%s: backslash is not a path separator in .apk, use '/'", name))
+		case hasDotSegment(name):
+			problems = append(problems, fmt.Errorf("%s: paths with '.' or '..' elements are rejected by Android", name))
+		}
+		if seen[name] {
+			problems = append(problems, fmt.Errorf("%s: duplicate entries are rejected by Android", name))
+		}
+		seen[name] = true
+		switch {
+		case class == classSpecial && !isJarIndex(name):
+			problems = append(problems, fmt.Errorf("%s: signature file kept from input doesn't match the new MANIFEST.MF, so Android rejects the .apk (use -replace-manifest to drop it)", name))
+		case class == classExcluded && !strings.HasPrefix(name, "META-INF/"):
+			problems = append(problems, fmt.Errorf("%s: not signed (-exclude), Android rejects unsigned entries outside META-INF/", name))
+		}
+	}
+	return problems
+}
+
+// hasDotSegment checks if slash-separated name has "." or ".." among its
+// elements.
+func hasDotSegment(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "." || elem == ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestLintEntries(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Excludes = []string{"assets/*.txt", "META-INF/*.stamp"}
+	names := []string{
+		"AndroidManifest.xml",
+		"/etc/passwd",
+		"res\\raw\\a.ogg",
+		"res/../../evil.so",
+		"res/./a.png",
+		"classes.dex",
+		"classes.dex",
+		"META-INF/CERT.SF",
+		"META-INF/OLD.RSA",
+		"META-INF/INDEX.LIST",
+		"META-INF/build.stamp",
+		"assets/readme.txt",
+		"res/a..b.png",
+	}
+	inputs := []inputFile{}
+	for _, name := range names {
+		inputs = append(inputs, inputFile{name: name})
+	}
+	got := []string{}
+	for _, err := range opts.lintEntries(inputs) {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		"/etc/passwd: absolute paths",
+		"res\\raw\\a.ogg: backslash",
+		"res/../../evil.so: paths with '.' or '..'",
+		"res/./a.png: paths with '.' or '..'",
+		"classes.dex: duplicate entries",
+		"META-INF/CERT.SF: duplicate entries",
+		"META-INF/CERT.SF: signature file kept from input",
+		"META-INF/OLD.RSA: signature file kept from input",
+		"assets/readme.txt: not signed (-exclude)",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got problems:\n%s\nwant %d", strings.Join(got, "\n"), len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("problem %d: got %q, want prefix %q", i, got[i], want[i])
+		}
+	}
+
+	// Dropped signature files are fine
+	opts.ReplaceManifest = true
+	if problems := opts.lintEntries(inputs[7:9]); len(problems) != 0 {
+		t.Errorf("with -replace-manifest, got problems %v, want none", problems)
+	}
+
+	opts.Strict = true
+	cert, key := testCertAndKey(t)
+	open := func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("x")), nil }
+	err := signFiles(zip.NewWriter(ioutil.Discard), []inputFile{{name: "res/../a.txt", open: open}}, cert, key, &opts)
+	if err == nil || !strings.Contains(err.Error(), "res/../a.txt: paths with") {
+		t.Errorf("with -strict, got error %v, want lint problem", err)
+	}
+}
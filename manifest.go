@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// manifest is a parsed JAR manifest or signature file (e.g. MANIFEST.MF,
+// CERT.SF). The main section is stored under key "", and the per-entry
+// sections under the value of their Name attribute.
+type manifest map[string]attributes
+
+// attributes are "Key: value" lines of a manifest section, in original order,
+// with wrapped lines already joined.
+type attributes []string
+
+// Get returns the value of the first attribute with the specified name,
+// compared case-insensitively, as in the JAR File Specification.
+func (as attributes) Get(name string) (string, bool) {
+	for _, attr := range as {
+		i := strings.Index(attr, ": ")
+		if i != -1 && strings.EqualFold(attr[:i], name) {
+			return attr[i+2:], true
+		}
+	}
+	return "", false
+}
+
+// parseManifest parses a JAR manifest or signature file. Both CRLF and LF line
+// endings are accepted.
+func parseManifest(r io.Reader) (manifest, error) {
+	m := manifest{}
+	err := scanManifest(r, func(name string, attrs attributes) error {
+		m[name] = attrs
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// scanManifest parses a JAR manifest or signature file like parseManifest,
+// but calls fn with each section as soon as it's read, instead of keeping
+// them all in memory. The main section is passed first, with name "" (and no
+// attributes if it's empty), then the per-entry sections named after their
+// Name attribute. An error returned from fn stops the scan, and is returned.
+// Errors in the manifest itself report the line number where the offending
+// attribute starts. Lines longer than 72 bytes (including CRLF), and more than
+// one section with the same name, are rejected.
+func scanManifest(r io.Reader, fn func(name string, attrs attributes) error) error {
+	var (
+		section attributes
+		starts  []int // line numbers where attributes of section start
+		inMain  = true
+		seen    = map[string]int{} // line numbers of Name attributes
+	)
+	flush := func() error {
+		if section == nil {
+			// Empty line right at the start ends an empty main section
+			if inMain {
+				inMain = false
+				return fn("", attributes{})
+			}
+			return nil
+		}
+		name := ""
+		if !inMain {
+			const prefix = "Name: "
+			if len(section[0]) < len(prefix) || !strings.EqualFold(section[0][:len(prefix)], prefix) {
+				return fmt.Errorf("manifest: line %d: section must start with Name attribute, got: %q", starts[0], section[0])
+			}
+			name = section[0][len(prefix):]
+			if err := checkName(name); err != nil {
+				return fmt.Errorf("manifest: line %d: %s", starts[0], err)
+			}
+			if first, ok := seen[name]; ok {
+				return fmt.Errorf("manifest: line %d: duplicate section of %q, first at line %d", starts[0], name, first)
+			}
+			seen[name] = starts[0]
+		}
+		for i, attr := range section {
+			if err := checkAttribute(attr); err != nil {
+				return fmt.Errorf("manifest: line %d: %s", starts[i], err)
+			}
+		}
+		attrs := section
+		section, starts, inMain = nil, nil, false
+		return fn(name, attrs)
+	}
+
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		// JAR spec: no line may be longer than 72 bytes, including CRLF
+		if len(line)+len("\r\n") > 72 {
+			return fmt.Errorf("manifest: line %d: longer than 72 bytes, must be wrapped: %q", n, line)
+		}
+		switch {
+		case line == "":
+			err := flush()
+			if err != nil {
+				return err
+			}
+		case line[0] == ' ':
+			if len(section) == 0 {
+				return fmt.Errorf("manifest: line %d: continuation line without preceding attribute: %q", n, line)
+			}
+			section[len(section)-1] += line[1:]
+		default:
+			section = append(section, line)
+			starts = append(starts, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("manifest: line %d: %s", n+1, err)
+	}
+	return flush()
+}
+
+// checkAttribute verifies that attr is a "name: value" line, as defined in the
+// JAR File Specification: name must be 1 to 70 alphanumeric characters, '-'
+// or '_', and value must not contain NUL, CR or LF characters.
+func checkAttribute(attr string) error {
+	i := strings.Index(attr, ": ")
+	if i == -1 {
+		return fmt.Errorf("attribute line must have format \"name: value\", got: %q", attr)
+	}
+	name, value := attr[:i], attr[i+2:]
+	if len(name) == 0 || len(name) > 70 {
+		return fmt.Errorf("attribute name must be 1 to 70 characters long, in line: %q", attr)
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("invalid character %q in attribute name, in line: %q", c, attr)
+		}
+	}
+	if strings.ContainsAny(value, "\x00\r\n") {
+		return fmt.Errorf("NUL, CR or LF not allowed in attribute value, in line: %q", attr)
+	}
+	return nil
+}
+
+// readExtraAttributes reads the -manifest-attrs file at path, in JAR manifest
+// format, with attributes to add to MANIFEST.MF: main section attributes, and
+// sections of entries. Digest attributes are not allowed, as they're always
+// calculated. If path is empty, an empty manifest is returned.
+func readExtraAttributes(path string) (manifest, error) {
+	if path == "" {
+		return manifest{}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := parseManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if _, ok := m[""].Get("Name"); ok {
+		// Most probably the main section is missing, so the first entry's
+		// section would end up in the main section of MANIFEST.MF
+		_, err := f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: manifest: line %d: Name attribute in main section (missing empty line before it?)", path, mainNameLine(f))
+	}
+	for name, attrs := range m {
+		for _, attr := range attrs {
+			if isDigestAttribute(attr) {
+				return nil, fmt.Errorf("%s: %s: digest attributes are calculated when signing, got: %q", path, name, attr)
+			}
+		}
+	}
+	return m, nil
+}
+
+// isDigestAttribute reports whether attr is a digest of an entry, e.g.
+// "SHA-256-Digest: ...", which must be calculated anew when signing.
+func isDigestAttribute(attr string) bool {
+	key := attr[:strings.Index(attr, ": ")]
+	return strings.HasSuffix(strings.ToUpper(key), "-DIGEST")
+}
+
+// mainNameLine returns the number of the line with Name attribute in the main
+// section of the manifest read from r, or 0 if there's none.
+func mainNameLine(r io.Reader) int {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		if i := strings.Index(line, ": "); i != -1 && strings.EqualFold(line[:i], "Name") {
+			return n
+		}
+	}
+	return 0
+}
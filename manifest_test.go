@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseManifest(t *testing.T) {
+	input := "" +
+		"Manifest-Version: 1.0\r\n" +
+		"Created-By: basia\r\n" +
+		"\r\n" +
+		"Name: res/drawable-xxxhdpi/a_very_long_file_name_which_needs_to_be_wra\r\n" +
+		" pped.png\r\n" +
+		"SHA1-Digest: 2jmj7l5rSw0yVb/vlWAYkK/YBwk=\r\n" +
+		"\r\n" +
+		"Name: res/a.txt\n" +
+		"SHA1-Digest: qvTGHdzF6KLavt4PO0gs2a6pQ00=\n" +
+		"\n"
+	got, err := parseManifest(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := manifest{
+		"": {"Manifest-Version: 1.0", "Created-By: basia"},
+		"res/drawable-xxxhdpi/a_very_long_file_name_which_needs_to_be_wrapped.png": {
+			"Name: res/drawable-xxxhdpi/a_very_long_file_name_which_needs_to_be_wrapped.png",
+			"SHA1-Digest: 2jmj7l5rSw0yVb/vlWAYkK/YBwk=",
+		},
+		"res/a.txt": {"Name: res/a.txt", "SHA1-Digest: qvTGHdzF6KLavt4PO0gs2a6pQ00="},
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Errorf("bad manifest, diff (-have +want):\n%s", diff)
+	}
+}
+
+func TestParseManifestControlChars(t *testing.T) {
+	input := "Manifest-Version: 1.0\r\n\r\nName: res/a\x00.txt\r\nSHA1-Digest: qvTGHdzF6KLavt4PO0gs2a6pQ00=\r\n\r\n"
+	_, err := parseManifest(strings.NewReader(input))
+	if err == nil || !strings.Contains(err.Error(), `"res/a\x00.txt"`) {
+		t.Errorf("want error about control characters in res/a\\x00.txt, got: %v", err)
+	}
+}
+
+func TestParseManifestWrappedNameEmptyMain(t *testing.T) {
+	name := "assets/" + strings.Repeat("0123456789", 13) + ".bin"
+	input := "\r\n" +
+		"Name: " + name[:64] + "\r\n" +
+		" " + name[64:133] + "\r\n" +
+		" " + name[133:] + "\r\n" +
+		"SHA1-Digest: 2jmj7l5rSw0yVb/vlWAYkK/YBwk=\r\n" +
+		"\r\n"
+	got, err := parseManifest(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := manifest{
+		"":   {},
+		name: {"Name: " + name, "SHA1-Digest: 2jmj7l5rSw0yVb/vlWAYkK/YBwk="},
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Errorf("bad manifest, diff (-have +want):\n%s", diff)
+	}
+}
+
+func TestParseManifestInvalidAttributes(t *testing.T) {
+	tests := []struct {
+		line, wantErr string
+	}{
+		{"SHA1-Digest:qvTGHdzF6KLavt4PO0gs2a6pQ00=", `must have format "name: value"`},
+		{"no separator", `must have format "name: value"`},
+		{": value", "must be 1 to 70 characters"},
+		{strings.Repeat("X", 70) + "\r\n X: value", "must be 1 to 70 characters"},
+		{"SHA1 Digest: qvTGHdzF6KLavt4PO0gs2a6pQ00=", `invalid character ' ' in attribute name, in line: "SHA1 Digest`},
+		{"Créé-Par: basia", `invalid character 'é'`},
+		{"Created-By: bas\ria", "CR or LF not allowed"},
+		{"Created-By: bas\x00ia", "CR or LF not allowed"},
+	}
+	for _, tt := range tests {
+		for lineNo, input := range map[int]string{
+			2: "Manifest-Version: 1.0\r\n" + tt.line + "\r\n\r\n",
+			4: "Manifest-Version: 1.0\r\n\r\nName: res/a.txt\r\n" + tt.line + "\r\n\r\n",
+		} {
+			_, err := parseManifest(strings.NewReader(input))
+			wantLine := fmt.Sprintf("manifest: line %d: ", lineNo)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.HasPrefix(err.Error(), wantLine) {
+				t.Errorf("%q: want error %q...%q, got: %v", input, wantLine, tt.wantErr, err)
+			}
+		}
+	}
+}
+
+func TestParseManifestErrorLines(t *testing.T) {
+	tests := []struct {
+		input, wantErr string
+	}{
+		{" continued\r\n", "manifest: line 1: continuation line without preceding attribute"},
+		{"Manifest-Version: 1.0\r\n\r\nName: res/a.txt\r\n\r\n\r\nSHA1-Digest: x\r\n\r\n", "manifest: line 6: section must start with Name attribute"},
+		{"Manifest-Version: 1.0\r\n\r\nName: res/a.t\r\n xt\r\nSHA1-Digest: x\r\nX: \x00\r\n", "manifest: line 6: NUL, CR or LF not allowed"},
+		{"Manifest-Version: 1.0\r\n\r\nName: a\x7fb\r\n\r\n", "manifest: line 3: \"a\\x7fb\": control characters"},
+		{"Manifest-Version: 1.0\r\n\r\nName: a\r\nX: 1\r\n\r\nName: b\r\n\r\nname: a\r\nX: 2\r\n\r\n", "manifest: line 8: duplicate section of \"a\", first at line 3"},
+	}
+	for _, tt := range tests {
+		_, err := parseManifest(strings.NewReader(tt.input))
+		if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+			t.Errorf("%q: want error starting with %q, got: %v", tt.input, tt.wantErr, err)
+		}
+	}
+}
+
+func TestParseManifestNameAnyCase(t *testing.T) {
+	m, err := parseManifest(strings.NewReader("Manifest-Version: 1.0\r\n\r\nNAME: res/a.txt\r\nX: 1\r\n\r\nname: res/b.txt\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"res/a.txt", "res/b.txt"} {
+		if _, ok := m[name]; !ok {
+			t.Errorf("got manifest %q, want section of %s", m, name)
+		}
+	}
+}
+
+func TestParseManifestLineLength(t *testing.T) {
+	// 70 bytes, and 72 with CRLF
+	line := "Name: res/" + strings.Repeat("a", 56) + ".png"
+	m, err := parseManifest(strings.NewReader("Manifest-Version: 1.0\r\n\r\n" + line + "\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m[strings.TrimPrefix(line, "Name: ")]; !ok {
+		t.Errorf("got manifest %q, want section of %s", m, line)
+	}
+	_, err = parseManifest(strings.NewReader("Manifest-Version: 1.0\r\n\r\n" + line + "a\r\n\r\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "manifest: line 3: longer than 72 bytes") {
+		t.Errorf("line of 73 bytes with CRLF: want error, got: %v", err)
+	}
+}
+
+func TestAttributesGet(t *testing.T) {
+	as := attributes{
+		"Name: res/a.txt",
+		"SHA1-Digest: qvTGHdzF6KLavt4PO0gs2a6pQ00=",
+		"sha-256-digest: LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=",
+		"X-Empty: ",
+		"SHA1-Digest: duplicate",
+	}
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"SHA1-Digest", "qvTGHdzF6KLavt4PO0gs2a6pQ00=", true},
+		{"sha1-digest", "qvTGHdzF6KLavt4PO0gs2a6pQ00=", true},
+		{"SHA-256-Digest", "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=", true},
+		{"X-Empty", "", true},
+		{"SHA1", "", false},
+		{"Name: res/a.txt", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := as.Get(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Get(%q) = %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func BenchmarkParseManifest(b *testing.B) {
+	opts := DefaultOptions()
+	buf := strings.Builder{}
+	buf.WriteString("Manifest-Version: 1.0\r\nCreated-By: basia\r\n\r\n")
+	for i := 0; i < 10000; i++ {
+		buf.WriteString(opts.joinBlock(
+			fmt.Sprintf("Name: res/drawable-xxxhdpi/a_very_long_file_name_which_needs_to_be_wrapped_%05d.png", i),
+			"SHA-256-Digest: LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="))
+	}
+	input := buf.String()
+
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := parseManifest(strings.NewReader(input))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestScanManifest(t *testing.T) {
+	input := "" +
+		"Manifest-Version: 1.0\r\n" +
+		"\r\n" +
+		"Name: res/b.txt\r\n" +
+		"SHA1-Digest: bbb\r\n" +
+		"\r\n" +
+		"Name: res/a.txt\r\n" +
+		"SHA1-Digest: aaa\r\n" +
+		"\r\n" +
+		"Name: res/c.txt\r\n" +
+		"SHA1-Digest: ccc\r\n"
+	got := []string{}
+	stop := errors.New("stop")
+	err := scanManifest(strings.NewReader(input), func(name string, attrs attributes) error {
+		got = append(got, fmt.Sprintf("%s=%v", name, attrs))
+		if name == "res/a.txt" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("got error %v, want %v returned from callback", err, stop)
+	}
+	want := []string{"=[Manifest-Version: 1.0]", "res/b.txt=[Name: res/b.txt SHA1-Digest: bbb]", "res/a.txt=[Name: res/a.txt SHA1-Digest: aaa]"}
+	if pretty.Compare(got, want) != "" {
+		t.Errorf("got sections %q, want %q in file order", got, want)
+	}
+
+	// Empty main section is still reported first
+	got = got[:0]
+	err = scanManifest(strings.NewReader("\r\nName: a\r\nX: y\r\n"), func(name string, attrs attributes) error {
+		got = append(got, fmt.Sprintf("%s=%v", name, attrs))
+		return nil
+	})
+	if want := []string{"=[]", "a=[Name: a X: y]"}; err != nil || pretty.Compare(got, want) != "" {
+		t.Errorf("got sections %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestSignAPKManifestAttrs(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	dir := testDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	opts.ManifestAttrs = filepath.Join(dir, "attrs.mf")
+	writeAttrs := func(s string) {
+		if err := ioutil.WriteFile(opts.ManifestAttrs, []byte(s), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "lib/a.class": "x"})
+
+	writeAttrs("Implementation-Version: 1.2\n\nName: lib/a.class\nSealed: true\n")
+	zr := signTestAPK(t, in, cert, key, opts)
+	m, err := readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m[""].Get("Implementation-Version"); v != "1.2" {
+		t.Errorf("got Implementation-Version %q in main section, want 1.2", v)
+	}
+	if got := m["lib/a.class"]; len(got) != 3 || got[1] != "Sealed: true" {
+		t.Errorf("got lib/a.class section %q, want Sealed: true between Name and digest", got)
+	}
+
+	tests := []struct {
+		attrs, wantErr string
+	}{
+		{"\nName: lib/c.class\nSealed: true\n\nName: lib/b.class\nSealed: true\n", "no such entries: lib/b.class, lib/c.class"},
+		{"Name: lib/a.class\nSealed: true\n", "line 1: Name attribute in main section"},
+		{"Implementation-Version: 1.2\nName: lib/a.class\nSealed: true\n", "line 2: Name attribute in main section"},
+		{"\nName: lib/a.class\nSHA1-Digest: xxx\n", "digest attributes are calculated"},
+		{"Manifest-Version: 2.0\n", "attribute already set in main section"},
+	}
+	for _, tt := range tests {
+		writeAttrs(tt.attrs)
+		err := SignAPK(bytes.NewReader(in), int64(len(in)), ioutil.Discard, cert, key, opts)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: got error %v, want %q", tt.attrs, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSignAPKMergeManifest(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	in := testZip(t, map[string]string{
+		"AndroidManifest.xml": "<manifest/>",
+		"lib/a.class":         "x",
+		"META-INF/MANIFEST.MF": "Manifest-Version: 1.0\r\nMain-Class: app.Main\r\nCreated-By: 1.8 (Foo)\r\n\r\n" +
+			"Name: lib/a.class\r\nSHA1-Digest: stale\r\nSealed: true\r\n\r\n" +
+			"Name: gone.txt\r\nSHA1-Digest: stale\r\n\r\n",
+	})
+
+	zr := signTestAPK(t, in, cert, key, opts)
+	m, err := readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m[""].Get("Main-Class"); v != "app.Main" {
+		t.Errorf("got Main-Class %q in main section, want app.Main", v)
+	}
+	if v, _ := m[""].Get("Created-By"); v != "1.8 (Foo)" {
+		t.Errorf("got Created-By %q in main section, want the one from input", v)
+	}
+	got := m["lib/a.class"]
+	if len(got) != 3 || got[1] != "Sealed: true" {
+		t.Errorf("got lib/a.class section %q, want Sealed: true between Name and digest", got)
+	}
+	if v, _ := got.Get("SHA1-Digest"); v == "stale" {
+		t.Errorf("stale digest of lib/a.class kept from input")
+	}
+	if _, ok := m["gone.txt"]; ok {
+		t.Errorf("got section of gone.txt, which is not in .apk")
+	}
+
+	opts.ReplaceManifest = true
+	zr = signTestAPK(t, in, cert, key, opts)
+	m, err = readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m[""].Get("Main-Class"); ok {
+		t.Errorf("got Main-Class in main section with -replace-manifest")
+	}
+	if got := m["lib/a.class"]; len(got) != 2 {
+		t.Errorf("got lib/a.class section %q with -replace-manifest, want just Name and digest", got)
+	}
+}
+
+func TestSignAPKMergeManifestAnyCase(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	in := testZip(t, map[string]string{
+		"AndroidManifest.xml":  "<manifest/>",
+		"meta-inf/Manifest.mf": "Manifest-Version: 1.0\r\nMain-Class: app.Main\r\n\r\n",
+	})
+	zr := signTestAPK(t, in, cert, key, DefaultOptions())
+	for _, zf := range zr.File[1:] {
+		if isManifest(zf.Name) {
+			t.Errorf("got %s kept in .apk besides %s", zf.Name, zr.File[0].Name)
+		}
+	}
+	m, err := readManifest(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m[""].Get("Main-Class"); v != "app.Main" {
+		t.Errorf("got Main-Class %q in main section, want app.Main from meta-inf/Manifest.mf", v)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"compress/flate"
+	"time"
+)
+
+// Options configure how an .apk is signed and written. Fields correspond to
+// command-line flags, named in comments; in the command-line tool, Options
+// are filled from the flags in main.
+type Options struct {
+	Level           int       // deflate compression level, from -1 (default) to 9 (-level)
+	NoCompress      bool      // store all entries uncompressed (-no-compress)
+	MinSdk          int       // minimum Android API level supported by the .apk (-min-sdk)
+	Digest          string    // v1 digest: "sha1", "sha256", "sha512", or "" to select based on MinSdk (-digest)
+	SigDigest       string    // digest in PKCS#7 signature of CERT.SF, or "" for same as Digest (-sig-digest)
+	CreatedBy       string    // Created-By attribute of MANIFEST.MF, omitted if empty (-created-by)
+	BuiltBy         string    // Built-By attribute of MANIFEST.MF, omitted if empty (-built-by)
+	Order           string    // order of entries: "android", "sorted" or "input" (-order)
+	EOL             string    // line ending in signature files: "crlf" or "lf" (-eol)
+	CreatorOS       string    // "", "unix" or "fat" (-creator-os)
+	JarIndex        string    // if not empty, regenerate META-INF/INDEX.LIST for JAR of this name (-jar-index)
+	SignerName      string    // name of v1 signature files, e.g. CERT for META-INF/CERT.SF (-signer-name)
+	StampComment    bool      // set .zip comment to certificate fingerprint and time (-stamp-comment)
+	CopyBuf         int       // size in bytes of the buffer for file contents (-copy-buf)
+	ReplaceManifest bool      // discard MANIFEST.MF and signature files found in input (-replace-manifest)
+	Strict          bool      // fail on problems which are otherwise warnings (-strict)
+	MaxManifestSize int       // fail if MANIFEST.MF would be larger; 0 means no limit (-max-manifest-size)
+	SigningTime     string    // "now", "none", or a time in RFC 3339 format (-signing-time)
+	ManifestAttrs   string    // file with extra attributes for MANIFEST.MF, if not empty (-manifest-attrs)
+	TSA             string    // URL of timestamp authority, if not empty (-tsa)
+	Detached        bool      // don't embed CERT.SF in its PKCS#7 signature, as required in JAR files (-detached)
+	Mtime           time.Time // modification time of all entries; zero means keeping time of entries from input .zip (-mtime)
+	ZeroMtime       bool      // set no modification time on any entry, also those from input .zip (-zero-mtime)
+	Excludes        []string  // glob patterns of files stored but not signed (-exclude)
+	Drops           []string  // glob patterns of files left out of the .apk (-drop)
+	Progress        Progress  // if not nil, notified of bytes processed while signing (-progress)
+}
+
+// DefaultOptions returns Options with the same values as defaults of the
+// command-line flags.
+func DefaultOptions() Options {
+	return Options{
+		Level:       flate.DefaultCompression,
+		MinSdk:      1,
+		CreatedBy:   "basia " + version,
+		BuiltBy:     "Generated-by-ADT",
+		Order:       "android",
+		EOL:         "crlf",
+		SignerName:  "CERT",
+		CopyBuf:     defaultCopyBuf,
+		SigningTime: "now",
+		Detached:    true,
+	}
+}
+
+// defaultCopyBuf is the default of -copy-buf.
+const defaultCopyBuf = 256 << 10
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestDefaultOptionsMatchFlags(t *testing.T) {
+	if diff := pretty.Compare(DefaultOptions(), flagOptions()); diff != "" {
+		t.Errorf("DefaultOptions differ from defaults of flags, diff (-have +want):\n%s", diff)
+	}
+}
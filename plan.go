@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// printPlan prints how each file from input (a directory or a .zip/.apk
+// file) would be treated when signing, without signing anything.
+func printPlan(w io.Writer, input string, opts *Options) error {
+	inputs, _, closer, err := openInput(context.Background(), input)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	sort.Slice(inputs, func(i, j int) bool {
+		return javaLess(inputs[i].name, inputs[j].name)
+	})
+	var failed error
+	for _, in := range inputs {
+		class, err := opts.classify(in.name)
+		if err != nil {
+			fmt.Fprintf(w, "%-9s %s: %s\n", "error", in.name, err)
+			failed = err
+			continue
+		}
+		fmt.Fprintf(w, "%-9s %s\n", class, in.name)
+	}
+	return failed
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	differ "github.com/kylelemons/godebug/diff"
+)
+
+func TestPrintPlan(t *testing.T) {
+	opts := DefaultOptions()
+	dir, err := ioutil.TempDir("", "basia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"AndroidManifest.xml", "META-INF/CERT.SF", "META-INF/MANIFEST.MF", "META-INF/build.stamp", "res/a.txt"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("x"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts.Excludes = []string{"META-INF/*.stamp"}
+
+	buf := bytes.NewBuffer(nil)
+	if err := printPlan(buf, dir, &opts); err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"signed    AndroidManifest.xml\n" +
+		"special   META-INF/CERT.SF\n" +
+		"merged    META-INF/MANIFEST.MF\n" +
+		"excluded  META-INF/build.stamp\n" +
+		"signed    res/a.txt\n"
+	if diff := differ.Diff(buf.String(), want); diff != "" {
+		t.Errorf("bad plan, diff (-have +want):\n%s", diff)
+	}
+
+	opts.ReplaceManifest = true
+	buf.Reset()
+	if err := printPlan(buf, dir, &opts); err != nil {
+		t.Fatal(err)
+	}
+	want = "" +
+		"signed    AndroidManifest.xml\n" +
+		"dropped   META-INF/CERT.SF\n" +
+		"dropped   META-INF/MANIFEST.MF\n" +
+		"excluded  META-INF/build.stamp\n" +
+		"signed    res/a.txt\n"
+	if diff := differ.Diff(buf.String(), want); diff != "" {
+		t.Errorf("bad plan with -replace-manifest, diff (-have +want):\n%s", diff)
+	}
+}
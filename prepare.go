@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// Signing in two steps, for keys which can't be used on the build machine
+// (e.g. in an air-gapped HSM):
+//
+//  1. prepareToFile writes a "prepared" .apk, which is the same as the signed
+//     .apk, except that the signature block file (e.g. META-INF/CERT.RSA) is
+//     missing. Next to it, at path output+".sf", the contents of its
+//     META-INF/CERT.SF file are written: these are the exact bytes to sign.
+//  2. The .sf file is signed elsewhere, into a detached PKCS#7 SignedData
+//     structure, in DER or PEM format, with the signing certificate included,
+//     e.g.:
+//     openssl cms -sign -binary -noattr -outform DER -in app.apk.sf -signer cert.pem -inkey key.pem -md sha256 -out app.apk.p7s
+//  3. finalizeToFile checks the signature, and writes the signed .apk: a copy
+//     of the prepared .apk, with the signature block file added right after
+//     CERT.SF.
+//
+// The same -signer-name must be used in both steps.
+
+// prepareToFile creates a prepared .apk file at path output, containing files
+// from input, and writes its CERT.SF to output+".sf" (see above). On error,
+// partially written output files are removed.
+func prepareToFile(ctx context.Context, output, input string, opts *Options) error {
+	err := signToFile(ctx, output, input, nil, nil, opts)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.OpenReader(output)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	sf, err := findPreparedSF(&zr.Reader, opts)
+	if err == nil {
+		err = writeFile(output+".sf", func(w io.Writer) error {
+			_, err := w.Write(sf)
+			return err
+		})
+	}
+	if err != nil {
+		os.Remove(output)
+		return fmt.Errorf("%s: %s", output, err)
+	}
+	return nil
+}
+
+// findPreparedSF returns contents of the CERT.SF file of a prepared .apk.
+func findPreparedSF(zr *zip.Reader, opts *Options) ([]byte, error) {
+	for _, zf := range zr.File {
+		if zf.Name == opts.signerPath(extSf) {
+			return readZipFile(zf)
+		}
+	}
+	return nil, fmt.Errorf("no %s found", opts.signerPath(extSf))
+}
+
+// finalizeToFile creates a signed .apk file at path output, from the prepared
+// .apk at path prepared, and the PKCS#7 signature of its CERT.SF from file at
+// path sigPath (see above). On error, the partially written output file is
+// removed.
+func finalizeToFile(ctx context.Context, output, prepared, sigPath string, opts *Options) error {
+	zr, err := zip.OpenReader(prepared)
+	if err != nil {
+		return fmt.Errorf("%s: %s", prepared, err)
+	}
+	defer zr.Close()
+	sf, err := findPreparedSF(&zr.Reader, opts)
+	if err != nil {
+		return fmt.Errorf("%s: %s", prepared, err)
+	}
+	inputs, err := listZip(&zr.Reader)
+	if err != nil {
+		return fmt.Errorf("%s: %s", prepared, err)
+	}
+
+	// Check the signature before writing anything
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(sig); block != nil {
+		sig = block.Bytes
+	}
+	p7, err := pkcs7.Parse(sig)
+	if err != nil {
+		return fmt.Errorf("%s: %s", sigPath, err)
+	}
+	if len(p7.Content) > 0 {
+		return fmt.Errorf("%s: signature must be detached, without CERT.SF embedded in it", sigPath)
+	}
+	p7.Content = sf
+	if err := p7.Verify(); err != nil {
+		return fmt.Errorf("%s: signature doesn't match CERT.SF of %s: %s", sigPath, prepared, err)
+	}
+	cert := p7.GetOnlySigner()
+	if cert == nil {
+		return fmt.Errorf("%s: expected exactly one signer, got %d", sigPath, len(p7.Signers))
+	}
+	blockName, err := opts.signatureBlockPath(cert.PublicKey)
+	if err != nil {
+		return fmt.Errorf("%s: %s", sigPath, err)
+	}
+	err = writeFile(output, func(w io.Writer) error {
+		zw := newZipWriter(w, opts.Level)
+		err := zw.SetComment(zr.Comment)
+		if err != nil {
+			return err
+		}
+		for _, in := range inputs {
+			if in.name == blockName {
+				return fmt.Errorf("%s: %s already exists", prepared, blockName)
+			}
+			fmt.Fprintln(logOutput, "+", in.name)
+			err := opts.copyFile(ctx, zw, in)
+			if err != nil {
+				return fmt.Errorf("%s: %s", in.name, err)
+			}
+			if in.name != opts.signerPath(extSf) {
+				continue
+			}
+			fmt.Fprintln(logOutput, "+", blockName)
+			fh, err := zw.CreateHeader(opts.newFileHeader(blockName, 0))
+			if err != nil {
+				return err
+			}
+			_, err = fh.Write(sig)
+			if err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	})
+	if err == nil && *verifyAfter {
+		_, err = verifyFile(output)
+		if err != nil {
+			os.Remove(output)
+			err = fmt.Errorf("verification failed: %s", err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/pkcs7"
+)
+
+func TestPrepareFinalize(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	dir := testDir(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	defer os.RemoveAll(dir)
+	out := testDir(t, map[string]string{})
+	defer os.RemoveAll(out)
+	prepared := filepath.Join(out, "prepared.apk")
+	ctx := context.Background()
+
+	err := prepareToFile(ctx, prepared, dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(prepared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAPK(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Error("prepared .apk verified, want missing signature")
+	}
+	sf, err := ioutil.ReadFile(prepared + ".sf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign the .sf elsewhere
+	sign := func(content []byte) string {
+		sd, err := pkcs7.NewSignedData(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+		err = sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sd.Detach()
+		sig, err := sd.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(out, "sig.p7s")
+		if err := ioutil.WriteFile(path, sig, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	signed := filepath.Join(out, "signed.apk")
+	err = finalizeToFile(ctx, signed, prepared, sign([]byte("something else")), &opts)
+	if err == nil || !strings.Contains(err.Error(), "doesn't match CERT.SF") {
+		t.Errorf("with wrong signature, got error %v, want mismatch", err)
+	}
+	if _, err := os.Stat(signed); !os.IsNotExist(err) {
+		t.Errorf("with wrong signature, output was written")
+	}
+
+	err = finalizeToFile(ctx, signed, prepared, sign(sf), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAPK(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Error(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, zf := range zr.File {
+		names = append(names, zf.Name)
+	}
+	want := "META-INF/MANIFEST.MF META-INF/CERT.SF META-INF/CERT.EC AndroidManifest.xml res/a.txt"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("got entries %q, want %q", got, want)
+	}
+}
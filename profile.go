@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+// loadProfile sets flags in fs from the JSON object in file at path, except
+// flags already set on the command line, which take precedence. Keys are flag
+// names (e.g. "c", "k", "digest", "created-by"), and values are strings,
+// numbers, booleans, or, for repeatable flags like "exclude", lists of
+// strings. For example:
+//
+//	{"c": "release.x509.pem", "k": "release.pk8", "digest": "sha256", "exclude": ["META-INF/*.stamp"]}
+func loadProfile(fs *flag.FlagSet, path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	err = dec.Decode(&values)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == "profile" {
+			return fmt.Errorf("%s: unknown flag: %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		var args []string
+		switch v := values[name].(type) {
+		case string:
+			args = []string{v}
+		case json.Number:
+			args = []string{v.String()}
+		case bool:
+			args = []string{strconv.FormatBool(v)}
+		case []interface{}:
+			for _, vv := range v {
+				s, ok := vv.(string)
+				if !ok {
+					return fmt.Errorf("%s: %s: expected a list of strings, got: %v", path, name, v)
+				}
+				args = append(args, s)
+			}
+		default:
+			return fmt.Errorf("%s: %s: expected a string, number, boolean or list of strings, got: %v", path, name, v)
+		}
+		for _, arg := range args {
+			err := fs.Set(name, arg)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %s", path, name, err)
+			}
+		}
+	}
+	return nil
+}
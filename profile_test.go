@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadProfile(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"basia.json": `{"c": "release.pem", "k": "release.pk8", "level": 9, "strict": true,
+			"created-by": "CI", "exclude": ["META-INF/*.stamp", "META-INF/x"]}`,
+		"unknown.json":   `{"c": "a.pem", "no-such-flag": 1}`,
+		"badvalue.json":  `{"exclude": [1, 2]}`,
+		"badsyntax.json": `{"c": `,
+	})
+	defer os.RemoveAll(dir)
+	newFlags := func() (*flag.FlagSet, map[string]interface{}) {
+		fs := flag.NewFlagSet("basia", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		excludes := &stringList{}
+		fs.Var(excludes, "exclude", "")
+		return fs, map[string]interface{}{
+			"c":          fs.String("c", "cert.x509.pem", ""),
+			"k":          fs.String("k", "key.pk8", ""),
+			"level":      fs.Int("level", -1, ""),
+			"strict":     fs.Bool("strict", false, ""),
+			"created-by": fs.String("created-by", "basia", ""),
+			"exclude":    excludes,
+		}
+	}
+
+	fs, vars := newFlags()
+	if err := fs.Parse([]string{"-k", "cli.pk8", "-exclude", "cli/*"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadProfile(fs, filepath.Join(dir, "basia.json")); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{
+		"c":          *vars["c"].(*string),
+		"k":          *vars["k"].(*string),
+		"level":      *vars["level"].(*int),
+		"strict":     *vars["strict"].(*bool),
+		"created-by": *vars["created-by"].(*string),
+		"exclude":    []string(*vars["exclude"].(*stringList)),
+	}
+	want := map[string]interface{}{
+		"c":          "release.pem",
+		"k":          "cli.pk8", // command line takes precedence
+		"level":      9,
+		"strict":     true,
+		"created-by": "CI",
+		"exclude":    []string{"cli/*"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got flags %v, want %v", got, want)
+	}
+
+	for file, wantErr := range map[string]string{
+		"unknown.json":   `unknown flag: "no-such-flag"`,
+		"badvalue.json":  "exclude: expected a list of strings",
+		"badsyntax.json": "unexpected EOF",
+		"missing.json":   "no such file",
+	} {
+		fs, _ := newFlags()
+		err := loadProfile(fs, filepath.Join(dir, file))
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: got error %v, want %q", file, err, wantErr)
+		}
+	}
+}
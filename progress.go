@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Progress receives updates on the number of bytes processed while signing:
+// hashed when calculating digests, and copied into the output .apk. The total
+// is known up front from sizes of input files.
+type Progress interface {
+	Progress(done, total int64)
+}
+
+// progressCounter counts bytes read from input files, reporting them to p.
+type progressCounter struct {
+	done, total int64
+	p           Progress
+}
+
+// wrapOpen returns a function opening files with open, but counting all bytes
+// read from them.
+func (c *progressCounter) wrapOpen(open func() (io.ReadCloser, error)) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		r, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return progressReader{r, c}, nil
+	}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	c *progressCounter
+}
+
+func (r progressReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	if n > 0 {
+		r.c.done += int64(n)
+		r.c.p.Progress(r.c.done, r.c.total)
+	}
+	return n, err
+}
+
+// progressBar is a Progress rendering a bar with percentage and estimated
+// remaining time in a terminal, redrawn at most every 100ms. It restarts when
+// done goes back, e.g. with the next .apk in sign-all.
+type progressBar struct {
+	w           io.Writer
+	start, last time.Time
+	prev        int64
+}
+
+func (b *progressBar) Progress(done, total int64) {
+	now := time.Now()
+	if b.start.IsZero() || done < b.prev {
+		b.start, b.last = now, time.Time{}
+	}
+	b.prev = done
+	if now.Sub(b.last) < 100*time.Millisecond && done < total {
+		return
+	}
+	b.last = now
+	const width = 30
+	frac := 1.0
+	if total > 0 {
+		frac = float64(done) / float64(total)
+	}
+	eta := "?"
+	if done > 0 {
+		elapsed := now.Sub(b.start)
+		eta = (time.Duration(float64(elapsed)/frac) - elapsed).Round(time.Second).String()
+	}
+	fmt.Fprintf(b.w, "\r[%-*s] %3.0f%% %d/%d MB, ETA %s ", width, strings.Repeat("#", int(frac*width)), frac*100, done>>20, total>>20, eta)
+	if done >= total {
+		fmt.Fprintln(b.w)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+type progressLog []int64
+
+func (l *progressLog) Progress(done, total int64) {
+	if len(*l) == 0 {
+		*l = append(*l, total)
+	}
+	*l = append(*l, done)
+}
+
+func TestSignFilesProgress(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	opts.Excludes = []string{"META-INF/*.stamp"}
+	log := &progressLog{}
+	opts.Progress = log
+
+	open := func(data string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader(data)), nil }
+	}
+	inputs := []inputFile{
+		{name: "res/a.txt", size: 100, open: open(strings.Repeat("a", 100))},
+		{name: "res/b.txt", size: 10, open: open(strings.Repeat("b", 10)), digest: "known"},
+		{name: "META-INF/x.stamp", size: 1, open: open("1")},
+	}
+	zw := zip.NewWriter(ioutil.Discard)
+	if err := signFiles(zw, inputs, cert, key, &opts); err != nil {
+		t.Fatal(err)
+	}
+	// res/a.txt hashed and copied, others only copied
+	const total = 2*100 + 10 + 1
+	if len(*log) < 2 || (*log)[0] != total {
+		t.Fatalf("got progress %v, want total %d first", *log, total)
+	}
+	prev := int64(0)
+	for _, done := range (*log)[1:] {
+		if done < prev || done > total {
+			t.Errorf("got progress %v, want monotonic up to %d", *log, total)
+			break
+		}
+		prev = done
+	}
+	if prev != total {
+		t.Errorf("got final progress %d, want %d", prev, total)
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	b := &progressBar{w: buf}
+	b.Progress(0, 4<<20)
+	b.Progress(1<<20, 4<<20) // throttled
+	b.Progress(4<<20, 4<<20)
+	lines := strings.Split(buf.String(), "\r")
+	if len(lines) != 3 {
+		t.Fatalf("got output %q, want 2 redraws", buf)
+	}
+	if want := "[                              ]   0% 0/4 MB, ETA ? "; lines[1] != want {
+		t.Errorf("got %q, want %q", lines[1], want)
+	}
+	if want := "[##############################] 100% 4/4 MB, ETA "; !strings.HasPrefix(lines[2], want) || !strings.HasSuffix(lines[2], "\n") {
+		t.Errorf("got %q, want prefix %q and a newline", lines[2], want)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// signatureSchemes tells which APK signature schemes an .apk is signed with.
+type signatureSchemes struct {
+	v1, v2, v3, v31, v4 bool
+}
+
+// detectSchemes checks which signature schemes the .apk of specified size,
+// read from r, is signed with: v1 (JAR) if there's a signature file in
+// META-INF/ with a matching signature block file, and v2, v3 and v3.1 if their
+// blocks are found in the APK Signing Block. Signatures are not verified. The
+// v4 scheme is never detected, as it's stored in a separate .apk.idsig file
+// (see detectFileSchemes).
+func detectSchemes(r io.ReaderAt, size int64) (signatureSchemes, error) {
+	var s signatureSchemes
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return s, err
+	}
+	for _, zf := range zr.File {
+		if isSignatureFile(zf.Name) && len(signatureBlocks(zr, zf.Name)) > 0 {
+			s.v1 = true
+		}
+	}
+
+	offset, length, err := findSigningBlock(r, size)
+	if err != nil || length == 0 {
+		return s, err
+	}
+	pairs, err := readSigningBlock(r, offset, length)
+	if err != nil {
+		return s, err
+	}
+	for _, p := range pairs {
+		switch p.id {
+		case sigBlockV2ID:
+			s.v2 = true
+		case sigBlockV3ID:
+			s.v3 = true
+		case sigBlockV31ID:
+			s.v31 = true
+		}
+	}
+	return s, nil
+}
+
+// DetectSchemes checks which APK signature schemes the .apk of specified size,
+// read from apk, is signed with (see detectSchemes); v3 includes v3.1. If apk
+// is an *os.File, it's signed with v4 if there's an .idsig file next to it.
+func DetectSchemes(apk io.ReaderAt, size int64) (v1, v2, v3, v4 bool, err error) {
+	s, err := detectSchemes(apk, size)
+	if err != nil {
+		return false, false, false, false, err
+	}
+	if f, ok := apk.(*os.File); ok {
+		_, err := os.Stat(f.Name() + ".idsig")
+		s.v4 = err == nil
+	}
+	return s.v1, s.v2, s.v3 || s.v31, s.v4, nil
+}
+
+// detectFileSchemes checks which signature schemes the .apk file at path is
+// signed with (see detectSchemes). It's also signed with v4 if there's a
+// path+".idsig" file next to it.
+func detectFileSchemes(path string) (signatureSchemes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return signatureSchemes{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return signatureSchemes{}, err
+	}
+	s, err := detectSchemes(f, fi.Size())
+	if err != nil {
+		return s, fmt.Errorf("%s: %s", path, err)
+	}
+	_, err = os.Stat(path + ".idsig")
+	s.v4 = err == nil
+	return s, nil
+}
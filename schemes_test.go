@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectSchemes(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	unsigned := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>"})
+	signed := bytes.NewBuffer(nil)
+	err := SignAPK(bytes.NewReader(unsigned), int64(len(unsigned)), signed, cert, key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		apk  []byte
+		want signatureSchemes
+	}{
+		{"unsigned", unsigned, signatureSchemes{}},
+		{"v1", signed.Bytes(), signatureSchemes{v1: true}},
+		{"v2+v3", withSigningBlock(t, unsigned, map[uint32][]byte{sigBlockV2ID: {0}, sigBlockV3ID: {0}}), signatureSchemes{v2: true, v3: true}},
+		{"v1+v3.1", withSigningBlock(t, signed.Bytes(), map[uint32][]byte{sigBlockV31ID: {0}}), signatureSchemes{v1: true, v31: true}},
+	}
+	for _, tt := range tests {
+		got, err := detectSchemes(bytes.NewReader(tt.apk), int64(len(tt.apk)))
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %+v, %v, want %+v", tt.name, got, err, tt.want)
+		}
+	}
+
+	// v4 signature is in a separate file
+	dir := testDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.apk")
+	apk := withSigningBlock(t, unsigned, map[uint32][]byte{sigBlockV2ID: {0}})
+	if err := ioutil.WriteFile(path, apk, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, v4 := range []bool{false, true} {
+		if v4 {
+			if err := ioutil.WriteFile(path+".idsig", []byte("idsig"), 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := detectFileSchemes(path)
+		if want := (signatureSchemes{v2: true, v4: v4}); err != nil || got != want {
+			t.Errorf("got %+v, %v, want %+v", got, err, want)
+		}
+	}
+}
+
+func TestDetectSchemesExported(t *testing.T) {
+	unsigned := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>"})
+	apk := withSigningBlock(t, unsigned, map[uint32][]byte{sigBlockV2ID: {0}, sigBlockV31ID: {0}})
+	v1, v2, v3, v4, err := DetectSchemes(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil || v1 || !v2 || !v3 || v4 {
+		t.Errorf("got v1=%v v2=%v v3=%v v4=%v, %v; want v2 and v3", v1, v2, v3, v4, err)
+	}
+
+	dir := testDir(t, map[string]string{"app.apk": string(apk), "app.apk.idsig": "idsig"})
+	defer os.RemoveAll(dir)
+	f, err := os.Open(filepath.Join(dir, "app.apk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, _, _, v4, err = DetectSchemes(f, int64(len(apk)))
+	if err != nil || !v4 {
+		t.Errorf("%s: got v4=%v, %v; want v4 from .idsig file", f.Name(), v4, err)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// https://source.android.com/security/apksigning/v2#apk-signing-block
+const (
+	apkSigBlockMagic = "APK Sig Block 42"
+
+	eocdSignature = 0x06054b50
+	eocdLen       = 22 // without the trailing comment
+	eocdMaxSearch = eocdLen + 0xffff
+
+	zip64LocatorSignature = 0x07064b50
+	zip64LocatorLen       = 20
+	zip64EOCDSignature    = 0x06064b50
+	zip64EOCDLen          = 56
+)
+
+// findEOCD returns the offset of the ZIP End of Central Directory record in r,
+// and the central directory offset read from it (or from the ZIP64 EOCD record,
+// if the archive has one).
+func findEOCD(r io.ReaderAt, size int64) (eocdOffset, cdOffset int64, err error) {
+	search := int64(eocdMaxSearch)
+	if search > size {
+		search = size
+	}
+	buf := make([]byte, search)
+	_, err = r.ReadAt(buf, size-search)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	for i := len(buf) - eocdLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(buf[i:]) != eocdSignature {
+			continue
+		}
+		commentLen := int(binary.LittleEndian.Uint16(buf[i+20:]))
+		if i+eocdLen+commentLen != len(buf) {
+			continue
+		}
+		eocdOffset = size - search + int64(i)
+		cdOffset = int64(binary.LittleEndian.Uint32(buf[i+16:]))
+		cdOffset64, ok, err := readZip64CDOffset(r, eocdOffset)
+		if ok {
+			cdOffset = cdOffset64
+		}
+		return eocdOffset, cdOffset, err
+	}
+	return 0, 0, errors.New("zip: end of central directory record not found")
+}
+
+// readZip64CDOffset reads the central directory offset from the ZIP64 EOCD
+// record, pointed to by the ZIP64 EOCD locator preceding the EOCD record. If
+// there's no ZIP64 EOCD locator, ok is false.
+func readZip64CDOffset(r io.ReaderAt, eocdOffset int64) (cdOffset int64, ok bool, err error) {
+	if eocdOffset < zip64LocatorLen {
+		return 0, false, nil
+	}
+	buf := make([]byte, zip64EOCDLen)
+	_, err = r.ReadAt(buf[:zip64LocatorLen], eocdOffset-zip64LocatorLen)
+	if err != nil {
+		return 0, false, err
+	}
+	if binary.LittleEndian.Uint32(buf) != zip64LocatorSignature {
+		return 0, false, nil
+	}
+	_, err = r.ReadAt(buf, int64(binary.LittleEndian.Uint64(buf[8:])))
+	if err != nil {
+		return 0, false, err
+	}
+	if binary.LittleEndian.Uint32(buf) != zip64EOCDSignature {
+		return 0, false, errors.New("zip: invalid ZIP64 end of central directory record")
+	}
+	return int64(binary.LittleEndian.Uint64(buf[48:])), true, nil
+}
+
+// findSigningBlock returns the offset and total length of the APK Signing
+// Block, which if present is located right before the central directory. If
+// there's no APK Signing Block in r, length is 0.
+func findSigningBlock(r io.ReaderAt, size int64) (offset, length int64, err error) {
+	_, cdOffset, err := findEOCD(r, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Footer of the block: uint64 size of block (excluding this field), magic
+	const footerLen = 8 + len(apkSigBlockMagic)
+	if cdOffset < int64(footerLen) || cdOffset > size {
+		return 0, 0, nil
+	}
+	footer := make([]byte, footerLen)
+	_, err = r.ReadAt(footer, cdOffset-int64(footerLen))
+	if err != nil {
+		return 0, 0, err
+	}
+	if string(footer[8:]) != apkSigBlockMagic {
+		return 0, 0, nil
+	}
+	blockSize := binary.LittleEndian.Uint64(footer)
+	if blockSize < uint64(footerLen) || blockSize > uint64(cdOffset-8) {
+		return 0, 0, fmt.Errorf("APK Signing Block: invalid size %d", blockSize)
+	}
+	offset = cdOffset - int64(blockSize) - 8
+	header := make([]byte, 8)
+	_, err = r.ReadAt(header, offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	if binary.LittleEndian.Uint64(header) != blockSize {
+		return 0, 0, fmt.Errorf("APK Signing Block: size in header (%d) differs from size in footer (%d)",
+			binary.LittleEndian.Uint64(header), blockSize)
+	}
+	return offset, int64(blockSize) + 8, nil
+}
+
+// computeV2ContentDigest calculates the digest of apk contents, as defined by
+// APK Signature Scheme v2, using hash function h. The three protected
+// sections (ZIP entries, central directory, end of central directory) are
+// split into 1 MiB chunks, which are digested separately; the result is a
+// digest of the chunks' digests. If apk already has an APK Signing Block, it
+// is excluded from the ZIP entries section, and the central directory offset
+// in EOCD is treated as pointing at the start of the block.
+//
+// See: https://source.android.com/security/apksigning/v2#integrity-protected-contents
+func computeV2ContentDigest(apk io.ReaderAt, size int64, h crypto.Hash) ([]byte, error) {
+	if !h.Available() {
+		return nil, fmt.Errorf("unsupported digest algorithm: %v", h)
+	}
+	eocdOffset, cdOffset, err := findEOCD(apk, size)
+	if err != nil {
+		return nil, err
+	}
+	entriesEnd, blockLen, err := findSigningBlock(apk, size)
+	if err != nil {
+		return nil, err
+	}
+	if blockLen == 0 {
+		entriesEnd = cdOffset
+	}
+	eocd := make([]byte, size-eocdOffset)
+	_, err = apk.ReadAt(eocd, eocdOffset)
+	if err != nil {
+		return nil, err
+	}
+	if _, zip64, _ := readZip64CDOffset(apk, eocdOffset); zip64 {
+		return nil, errors.New("ZIP64 archives are not supported by APK Signature Scheme v2")
+	}
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(entriesEnd))
+
+	const chunkSize = 1 << 20
+	sections := []*io.SectionReader{
+		io.NewSectionReader(apk, 0, entriesEnd),
+		io.NewSectionReader(apk, cdOffset, eocdOffset-cdOffset),
+		io.NewSectionReader(bytes.NewReader(eocd), 0, int64(len(eocd))),
+	}
+	chunks := []byte{}
+	nchunks := 0
+	buf := make([]byte, chunkSize)
+	for _, sec := range sections {
+		for off := int64(0); off < sec.Size(); off += chunkSize {
+			n := sec.Size() - off
+			if n > chunkSize {
+				n = chunkSize
+			}
+			_, err := sec.ReadAt(buf[:n], off)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			calc := h.New()
+			prefix := [5]byte{0xa5}
+			binary.LittleEndian.PutUint32(prefix[1:], uint32(n))
+			calc.Write(prefix[:])
+			calc.Write(buf[:n])
+			chunks = calc.Sum(chunks)
+			nchunks++
+		}
+	}
+	calc := h.New()
+	prefix := [5]byte{0x5a}
+	binary.LittleEndian.PutUint32(prefix[1:], uint32(nchunks))
+	calc.Write(prefix[:])
+	calc.Write(chunks)
+	return calc.Sum(nil), nil
+}
+
+// IDs of known ID-value pairs in APK Signing Block.
+const (
+	sigBlockV2ID      = 0x7109871a
+	sigBlockV3ID      = 0xf05368c0
+	sigBlockV31ID     = 0x1b93ad61
+	sigBlockPaddingID = 0x42726577
+)
+
+type sigBlockPair struct {
+	id    uint32
+	value []byte
+}
+
+// readSigningBlock parses ID-value pairs from the APK Signing Block found at
+// the specified offset and length in r (see findSigningBlock).
+func readSigningBlock(r io.ReaderAt, offset, length int64) ([]sigBlockPair, error) {
+	// Skip the leading size field, and the trailing size field and magic
+	const overhead = 8 + 8 + len(apkSigBlockMagic)
+	if length < int64(overhead) {
+		return nil, fmt.Errorf("APK Signing Block: too short: %d", length)
+	}
+	buf := make([]byte, length-int64(overhead))
+	_, err := r.ReadAt(buf, offset+8)
+	if err != nil {
+		return nil, err
+	}
+	pairs := []sigBlockPair{}
+	for len(buf) > 0 {
+		if len(buf) < 12 {
+			return nil, fmt.Errorf("APK Signing Block: truncated ID-value pair #%d", len(pairs)+1)
+		}
+		n := binary.LittleEndian.Uint64(buf)
+		if n < 4 || n > uint64(len(buf)-8) {
+			return nil, fmt.Errorf("APK Signing Block: invalid length %d of ID-value pair #%d", n, len(pairs)+1)
+		}
+		pairs = append(pairs, sigBlockPair{
+			id:    binary.LittleEndian.Uint32(buf[8:]),
+			value: buf[12 : 8+n],
+		})
+		buf = buf[8+n:]
+	}
+	return pairs, nil
+}
+
+// Names of signature algorithm IDs used in v2+ signature schemes.
+// See: https://source.android.com/security/apksigning/v2#signature-algorithm-ids
+var sigAlgorithmNames = map[uint32]string{
+	0x0101: "RSASSA-PSS with SHA2-256",
+	0x0102: "RSASSA-PSS with SHA2-512",
+	0x0103: "RSASSA-PKCS1-v1_5 with SHA2-256",
+	0x0104: "RSASSA-PKCS1-v1_5 with SHA2-512",
+	0x0201: "ECDSA with SHA2-256",
+	0x0202: "ECDSA with SHA2-512",
+	0x0301: "DSA with SHA2-256",
+	0x0421: "RSASSA-PKCS1-v1_5 with SHA2-256 (verity)",
+	0x0423: "ECDSA with SHA2-256 (verity)",
+	0x0425: "DSA with SHA2-256 (verity)",
+}
+
+// parseSignerAlgorithms returns, for each signer found in the value of a v2 or
+// v3 signature scheme block, IDs of the algorithms listed in the signer's
+// signed data digests.
+func parseSignerAlgorithms(value []byte) ([][]uint32, error) {
+	signers, _, err := lengthPrefixed(value)
+	if err != nil {
+		return nil, fmt.Errorf("signers: %s", err)
+	}
+	algos := [][]uint32{}
+	for len(signers) > 0 {
+		var signer, signedData, digests []byte
+		signer, signers, err = lengthPrefixed(signers)
+		if err == nil {
+			signedData, _, err = lengthPrefixed(signer)
+		}
+		if err == nil {
+			digests, _, err = lengthPrefixed(signedData)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("signer #%d: %s", len(algos)+1, err)
+		}
+		ids := []uint32{}
+		for len(digests) > 0 {
+			var digest []byte
+			digest, digests, err = lengthPrefixed(digests)
+			if err == nil && len(digest) < 4 {
+				err = errors.New("digest too short")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("signer #%d: digest #%d: %s", len(algos)+1, len(ids)+1, err)
+			}
+			ids = append(ids, binary.LittleEndian.Uint32(digest))
+		}
+		algos = append(algos, ids)
+	}
+	return algos, nil
+}
+
+// lengthPrefixed splits a value prefixed with its uint32 length off the start
+// of buf.
+func lengthPrefixed(buf []byte) (value, rest []byte, err error) {
+	if len(buf) < 4 {
+		return nil, nil, errors.New("truncated length prefix")
+	}
+	n := binary.LittleEndian.Uint32(buf)
+	if uint64(n) > uint64(len(buf)-4) {
+		return nil, nil, fmt.Errorf("length %d exceeds remaining %d bytes", n, len(buf)-4)
+	}
+	return buf[4 : 4+n], buf[4+n:], nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// signAll re-signs in place all .apk files found under dir. A failure to sign
+// one file doesn't stop processing of the remaining ones; a summary is printed
+// at the end.
+func signAll(ctx context.Context, dir string, cert *x509.Certificate, key crypto.Signer, opts *Options) error {
+	paths := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(strings.ToLower(path), ".apk") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no .apk files found in: %s", dir)
+	}
+	return signBatch(ctx, paths, func(path string) error {
+		return signInPlace(ctx, path, cert, key, opts)
+	})
+}
+
+// signDirs signs each top-level subdirectory of dir into a separate .apk file
+// in outDir, named after the subdirectory. Other files in dir are skipped. A
+// failure to sign one .apk doesn't stop processing of the remaining ones; a
+// summary is printed at the end. If outDir is a subdirectory of dir, it's
+// skipped, and it must not be inside any of the other subdirectories.
+func signDirs(ctx context.Context, dir, outDir string, cert *x509.Certificate, key crypto.Signer, opts *Options) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	outInfo, _ := os.Stat(outDir) // nil if not created yet
+	paths := []string{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		if outInfo != nil && os.SameFile(info, outInfo) {
+			continue // don't sign the outputs
+		}
+		if isInsideDir(outDir, path) {
+			return fmt.Errorf("%s: output directory %s is inside, so it would be signed into the .apk", path, outDir)
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no subdirectories found in: %s", dir)
+	}
+	err = os.MkdirAll(outDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	// Output names could collide e.g. on case-insensitive filesystems
+	outputs := map[string]string{}
+	return signBatch(ctx, paths, func(path string) error {
+		output := filepath.Join(outDir, filepath.Base(path)+".apk")
+		if prev, ok := outputs[strings.ToLower(output)]; ok {
+			return fmt.Errorf("%s: name collides with output of: %s", output, prev)
+		}
+		outputs[strings.ToLower(output)] = path
+		return signToFile(ctx, output, path, cert, key, opts)
+	})
+}
+
+// isInsideDir checks if path is inside directory dir, or is dir itself.
+func isInsideDir(path, dir string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// signBatch calls sign for each of paths, continuing after failures, then
+// prints a summary and returns an error if any of the calls failed.
+func signBatch(ctx context.Context, paths []string, sign func(path string) error) error {
+	failed := map[string]error{}
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fmt.Println("*", path)
+		err := sign(path)
+		if err != nil {
+			failed[path] = err
+		}
+	}
+
+	fmt.Printf("signed %d of %d .apk files\n", len(paths)-len(failed), len(paths))
+	if len(failed) > 0 {
+		for _, path := range paths {
+			if err, ok := failed[path]; ok {
+				fmt.Printf("FAILED: %s\n  %s\n", path, err)
+			}
+		}
+		return fmt.Errorf("failed to sign %d .apk file(s)", len(failed))
+	}
+	return nil
+}
+
+// signInPlace signs the .apk at path into a temporary file in the same
+// directory, then renames it over the original.
+func signInPlace(ctx context.Context, path string, cert *x509.Certificate, key crypto.Signer, opts *Options) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".basia-*.apk")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	err = signToFile(ctx, tmp.Name(), path, cert, key, opts)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), fi.Mode())
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignDirs(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	dir, err := ioutil.TempDir("", "basia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, path := range []string{"in/App/res/a.txt", "in/app/res/b.txt", "in/other/c.txt", "in/file.txt"} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("x"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "out")
+	err = signDirs(context.Background(), filepath.Join(dir, "in"), out, cert, key, &opts)
+	if err == nil || !strings.Contains(err.Error(), "failed to sign 1") {
+		t.Errorf("want failure for colliding app/App, got: %v", err)
+	}
+	infos, err := ioutil.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, info := range infos {
+		got = append(got, info.Name())
+	}
+	if want := "App.apk other.apk"; strings.Join(got, " ") != want {
+		t.Errorf("got outputs %q, want %q", got, want)
+	}
+}
+
+func TestSignDirsOutputInside(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	dir := testDir(t, map[string]string{"app/res/a.txt": "x", "out/old.apk": "not an .apk"})
+	defer os.RemoveAll(dir)
+
+	// Signed twice, as the second run would find app.apk in out/
+	for i := 0; i < 2; i++ {
+		err := signDirs(context.Background(), dir, filepath.Join(dir, "out"), cert, key, &opts)
+		if err != nil {
+			t.Fatalf("run %d: %s", i+1, err)
+		}
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, info := range infos {
+		got = append(got, info.Name())
+	}
+	if want := "app.apk old.apk"; strings.Join(got, " ") != want {
+		t.Errorf("got outputs %q, want %q", got, want)
+	}
+
+	err = signDirs(context.Background(), dir, filepath.Join(dir, "app", "out"), cert, key, &opts)
+	if err == nil || !strings.Contains(err.Error(), "is inside") {
+		t.Errorf("-o inside a subdirectory of -i: want error, got: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+)
+
+// stripToFile creates an unsigned .apk file at path output, containing all
+// files from .zip/.apk file input except the JAR signature files. The APK
+// Signing Block (v2+ signatures), if any, is dropped too, as the output is
+// always written from scratch. On error, the partially written output file is
+// removed.
+func stripToFile(ctx context.Context, output, input string, opts *Options) error {
+	zr, err := zip.OpenReader(input)
+	if err != nil {
+		return fmt.Errorf("%s: %s", input, err)
+	}
+	defer zr.Close()
+	inputs, err := listZip(&zr.Reader)
+	if err != nil {
+		return fmt.Errorf("%s: %s", input, err)
+	}
+
+	return writeFile(output, func(w io.Writer) error {
+		zw := newZipWriter(w, opts.Level)
+		err := zw.SetComment(zr.Comment)
+		if err != nil {
+			return err
+		}
+		err = stripFiles(ctx, zw, inputs, opts)
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+// stripFiles writes to zw all inputs except the JAR signature files.
+func stripFiles(ctx context.Context, zw *zip.Writer, inputs []inputFile, opts *Options) error {
+	for _, in := range inputs {
+		if isSpecialIgnored(in.name) {
+			fmt.Fprintln(logOutput, "-", in.name)
+			continue
+		}
+		fmt.Fprintln(logOutput, "+", in.name)
+		err := opts.copyFile(ctx, zw, in)
+		if err != nil {
+			return fmt.Errorf("%s: %s", in.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestStripFiles(t *testing.T) {
+	opts := DefaultOptions()
+	data := testZip(t, map[string]string{
+		"AndroidManifest.xml":  "<manifest/>",
+		"classes.dex":          "dex",
+		"META-INF/MANIFEST.MF": "Manifest-Version: 1.0\r\n\r\n",
+		"META-INF/CERT.SF":     "Signature-Version: 1.0\r\n\r\n",
+		"META-INF/CERT.RSA":    "rsa",
+		"META-INF/foo.ec":      "ec",
+		"META-INF/SIG-X":       "sig",
+		"META-INF/services/x":  "service",
+	})
+	data = withSigningBlock(t, data, map[uint32][]byte{sigBlockV2ID: []byte("v2 signature")})
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, err := listZip(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(out)
+	if err := stripFiles(context.Background(), zw, inputs, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err = zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, f := range zr.File {
+		got = append(got, f.Name)
+	}
+	sort.Strings(got) // testZip writes entries in random order
+	want := "AndroidManifest.xml META-INF/services/x classes.dex"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got entries %q, want %q", got, want)
+	}
+	_, n, err := findSigningBlock(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil || n != 0 {
+		t.Errorf("got APK Signing Block of length %d (err: %v), want none", n, err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// oidTimeStampToken identifies the unsigned attribute of a PKCS#7 SignerInfo
+// with an RFC 3161 timestamp token over its signature (RFC 3161, appendix A).
+var oidTimeStampToken = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+
+// ASN.1 structures of RFC 3161 used by basia, with fields it doesn't need
+// omitted where possible.
+type (
+	messageImprint struct {
+		HashAlgorithm pkix.AlgorithmIdentifier
+		HashedMessage []byte
+	}
+	timeStampReq struct {
+		Version        int
+		MessageImprint messageImprint
+		Nonce          *big.Int `asn1:"optional"`
+		CertReq        bool     `asn1:"optional"`
+	}
+	pkiStatusInfo struct {
+		Status       int
+		StatusString []string       `asn1:"optional"`
+		FailInfo     asn1.BitString `asn1:"optional"`
+	}
+	timeStampResp struct {
+		Status         pkiStatusInfo
+		TimeStampToken asn1.RawValue `asn1:"optional"`
+	}
+	tstInfo struct {
+		Version        int
+		Policy         asn1.ObjectIdentifier
+		MessageImprint messageImprint
+		SerialNumber   *big.Int
+		GenTime        time.Time `asn1:"generalized"`
+		Accuracy       struct {
+			Seconds int `asn1:"optional"`
+			Millis  int `asn1:"optional,tag:0"`
+			Micros  int `asn1:"optional,tag:1"`
+		} `asn1:"optional"`
+		Ordering bool     `asn1:"optional"`
+		Nonce    *big.Int `asn1:"optional"`
+	}
+)
+
+// timestamp requests an RFC 3161 timestamp token over signature from the
+// timestamp authority at url, using digest algorithm h. The token's signature
+// and contents are checked before it's returned.
+func timestamp(url string, signature []byte, h crypto.Hash) ([]byte, error) {
+	oid, ok := digestOIDs[h]
+	if !ok {
+		return nil, fmt.Errorf("unsupported timestamp digest algorithm: %v", h)
+	}
+	digest := h.New()
+	digest.Write(signature)
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	imprint := messageImprint{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oid},
+		HashedMessage: digest.Sum(nil),
+	}
+	req, err := asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: imprint,
+		Nonce:          nonce,
+		CertReq:        true, // so that the token can be verified on its own
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Post(url, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	var tsr timeStampResp
+	if _, err := asn1.Unmarshal(body, &tsr); err != nil {
+		return nil, fmt.Errorf("%s: bad timestamp response: %s", url, err)
+	}
+	// 0 is granted, 1 is grantedWithMods
+	if s := tsr.Status; s.Status > 1 {
+		return nil, fmt.Errorf("%s: timestamp rejected with status %d: %s (failure info: %x)", url, s.Status, strings.Join(s.StatusString, "; "), s.FailInfo.Bytes)
+	}
+	token := tsr.TimeStampToken.FullBytes
+	if err := checkTimestamp(token, imprint, nonce); err != nil {
+		return nil, fmt.Errorf("%s: bad timestamp token: %s", url, err)
+	}
+	return token, nil
+}
+
+// checkTimestamp verifies the signature of a timestamp token, and that it
+// was issued for the requested message imprint and nonce.
+func checkTimestamp(token []byte, imprint messageImprint, nonce *big.Int) error {
+	if len(token) == 0 {
+		return errors.New("no token in response")
+	}
+	p7, err := pkcs7.Parse(token)
+	if err != nil {
+		return err
+	}
+	if err := p7.Verify(); err != nil {
+		return err
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(p7.Content, &info); err != nil {
+		return err
+	}
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(imprint.HashAlgorithm.Algorithm) ||
+		!bytes.Equal(info.MessageImprint.HashedMessage, imprint.HashedMessage) {
+		return errors.New("message imprint doesn't match the signature")
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return errors.New("nonce doesn't match the request")
+	}
+	return nil
+}
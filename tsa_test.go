@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// testTSA returns a timestamp authority server, answering with the status
+// returned from the optional respond function, which can also modify the
+// issued token info.
+func testTSA(t *testing.T, respond func(info *tstInfo) int) *httptest.Server {
+	cert, key := testCertAndKey(t)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var req timeStampReq
+		if _, err := asn1.Unmarshal(body, &req); err != nil || r.Header.Get("Content-Type") != "application/timestamp-query" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		info := tstInfo{
+			Version:        1,
+			Policy:         asn1.ObjectIdentifier{1, 2, 3, 4},
+			MessageImprint: req.MessageImprint,
+			SerialNumber:   big.NewInt(42),
+			GenTime:        time.Now().UTC().Truncate(time.Second),
+			Nonce:          req.Nonce,
+		}
+		status := 0
+		if respond != nil {
+			status = respond(&info)
+		}
+		resp := timeStampResp{Status: pkiStatusInfo{Status: status}}
+		if status <= 1 {
+			content, err := asn1.Marshal(info)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			sd, err := pkcs7.NewSignedData(content)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			token, err := sd.Finish()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.TimeStampToken = asn1.RawValue{FullBytes: token}
+		} else {
+			resp.Status.StatusString = []string{"no way"}
+		}
+		buf, err := asn1.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		w.Write(buf)
+	}))
+}
+
+func TestSignAPKTimestamp(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	tsa := testTSA(t, nil)
+	defer tsa.Close()
+	opts.TSA = tsa.URL
+
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>"})
+	zr := signTestAPK(t, in, cert, key, opts)
+	var block []byte
+	for _, zf := range zr.File {
+		if zf.Name == "META-INF/CERT.EC" {
+			buf, err := readZipFile(zf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block = buf
+		}
+	}
+	p7, err := pkcs7.Parse(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, attr := range p7.Signers[0].UnauthenticatedAttributes {
+		found = found || attr.Type.Equal(oidTimeStampToken)
+	}
+	if !found {
+		t.Errorf("no timestamp token found in unsigned attributes of CERT.EC")
+	}
+
+	tests := []struct {
+		name    string
+		respond func(info *tstInfo) int
+		wantErr string
+	}{
+		{"rejected", func(*tstInfo) int { return 2 }, "timestamp rejected with status 2: no way"},
+		{"wrong nonce", func(info *tstInfo) int { info.Nonce = big.NewInt(1); return 0 }, "nonce doesn't match"},
+		{"wrong imprint", func(info *tstInfo) int { info.MessageImprint.HashedMessage[0]++; return 0 }, "message imprint doesn't match"},
+	}
+	for _, tt := range tests {
+		tsa := testTSA(t, tt.respond)
+		opts.TSA = tsa.URL
+		err := SignAPK(bytes.NewReader(in), int64(len(in)), ioutil.Discard, cert, key, opts)
+		tsa.Close()
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// v1Signer describes a signer of a verified v1 (JAR) signature, found in a
+// SignerInfo of the PKCS#7 signature block.
+type v1Signer struct {
+	file      string // signature block file, e.g. META-INF/CERT.RSA
+	cert      *x509.Certificate
+	digestOID asn1.ObjectIdentifier
+	sigOID    asn1.ObjectIdentifier // "digest encryption" algorithm in PKCS#7
+}
+
+// verifyFile verifies the v1 (JAR) signature of the .apk file at path (see
+// verifyAPK).
+func verifyFile(path string) ([]v1Signer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	signers, err := verifyAPK(f, fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return signers, nil
+}
+
+// isSignatureFile reports whether name is a v1 signature file, e.g.
+// META-INF/CERT.SF. Like in isSpecialIgnored, case is ignored.
+func isSignatureFile(name string) bool {
+	return isSpecialIgnored(name) && strings.EqualFold(path.Ext(name), ".SF")
+}
+
+// signatureBlocks returns the signature block files (.RSA, .EC or .DSA, in
+// this order) found in zr for the signature file named sfName, comparing
+// names case-insensitively.
+func signatureBlocks(zr *zip.Reader, sfName string) []*zip.File {
+	base := sfName[:len(sfName)-len(".SF")]
+	blocks := []*zip.File{}
+	for _, ext := range []string{".RSA", ".EC", ".DSA"} {
+		for _, zf := range zr.File {
+			if strings.EqualFold(zf.Name, base+ext) {
+				blocks = append(blocks, zf)
+			}
+		}
+	}
+	return blocks
+}
+
+// verifyAPK verifies the v1 (JAR) signature of the .apk of specified size,
+// read from r, and returns details of its signers. Digests of all
+// entries are recalculated and compared with MANIFEST.MF, digests of
+// MANIFEST.MF and its sections with each of the signature files (e.g.
+// CERT.SF), and the PKCS#7 signature of each signature file is checked.
+// As on Android, entries in META-INF/ (e.g. INDEX.LIST, or those matching
+// -exclude patterns) don't need to be listed in MANIFEST.MF.
+func verifyAPK(r io.ReaderAt, size int64) ([]v1Signer, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	mf := findManifest(zr)
+	if mf == nil {
+		return nil, errors.New("no META-INF/MANIFEST.MF found")
+	}
+	rawMf, err := readZipFile(mf)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseManifest(bytes.NewReader(rawMf))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", mf.Name, err)
+	}
+
+	// Digests of entries
+	listed := map[string]bool{}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || isSpecialIgnored(zf.Name) {
+			continue
+		}
+		attrs, ok := m[zf.Name]
+		if !ok {
+			if strings.HasPrefix(zf.Name, "META-INF/") {
+				continue // unsigned files are allowed there, e.g. -exclude'd
+			}
+			return nil, fmt.Errorf("%s: not listed in MANIFEST.MF", zf.Name)
+		}
+		listed[zf.Name] = true
+		h, want, ok := findDigest(attrs, "")
+		if !ok {
+			return nil, fmt.Errorf("%s: no known digest attribute in MANIFEST.MF", zf.Name)
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", zf.Name, err)
+		}
+		sum, err := hashsum(h, rc, defaultCopyBuf)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", zf.Name, err)
+		}
+		if got := base64enc(sum); got != want {
+			return nil, fmt.Errorf("%s: %s mismatch: MANIFEST.MF has %s, calculated %s", zf.Name, digestAttrs[h], want, got)
+		}
+	}
+	for name := range m {
+		if name != "" && !listed[name] {
+			return nil, fmt.Errorf("%s: listed in MANIFEST.MF but not found in .apk", name)
+		}
+	}
+
+	// Signature files
+	mainSection, sections, err := splitManifestSections(rawMf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", mf.Name, err)
+	}
+	signers := []v1Signer{}
+	for _, zf := range zr.File {
+		if !isSignatureFile(zf.Name) {
+			continue
+		}
+		rawSf, err := readZipFile(zf)
+		if err != nil {
+			return nil, err
+		}
+		blocks := signatureBlocks(zr, zf.Name)
+		if len(blocks) == 0 {
+			return nil, fmt.Errorf("%s: no signature block file found", zf.Name)
+		}
+		block := blocks[0]
+		rawBlock, err := readZipFile(block)
+		if err != nil {
+			return nil, err
+		}
+		p7, err := pkcs7.Parse(rawBlock)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", block.Name, err)
+		}
+		p7.Content = rawSf
+		if err := p7.Verify(); err != nil {
+			return nil, fmt.Errorf("%s: %s", block.Name, err)
+		}
+		for _, si := range p7.Signers {
+			var cert *x509.Certificate
+			for _, c := range p7.Certificates {
+				if c.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 &&
+					bytes.Equal(c.RawIssuer, si.IssuerAndSerialNumber.IssuerName.FullBytes) {
+					cert = c
+				}
+			}
+			if cert == nil {
+				return nil, fmt.Errorf("%s: no certificate found for signer with serial %s", block.Name, si.IssuerAndSerialNumber.SerialNumber)
+			}
+			signers = append(signers, v1Signer{
+				file:      block.Name,
+				cert:      cert,
+				digestOID: si.DigestAlgorithm.Algorithm,
+				sigOID:    si.DigestEncryptionAlgorithm.Algorithm,
+			})
+		}
+
+		sf, err := parseManifest(bytes.NewReader(rawSf))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", zf.Name, err)
+		}
+		err = verifySignatureFile(sf, rawMf, mainSection, sections)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", zf.Name, err)
+		}
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("no signature files found in META-INF/")
+	}
+	return signers, nil
+}
+
+// verifySignatureFile compares digests found in the parsed signature file sf
+// with digests of the raw MANIFEST.MF, its main section, and its per-entry
+// sections (keyed by name).
+func verifySignatureFile(sf manifest, rawMf, mainSection []byte, sections map[string][]byte) error {
+	h, want, ok := findDigest(sf[""], "-Manifest")
+	if !ok {
+		return errors.New("no known digest attribute of MANIFEST.MF")
+	}
+	if got := base64sum(h, string(rawMf)); got != want {
+		return fmt.Errorf("%s-Manifest mismatch: has %s, calculated %s", digestAttrs[h], want, got)
+	}
+	if h, want, ok := findDigest(sf[""], "-Manifest-Main-Attributes"); ok {
+		if got := base64sum(h, string(mainSection)); got != want {
+			return fmt.Errorf("%s-Manifest-Main-Attributes mismatch: has %s, calculated %s", digestAttrs[h], want, got)
+		}
+	}
+	for name, attrs := range sf {
+		if name == "" {
+			continue
+		}
+		section, ok := sections[name]
+		if !ok {
+			return fmt.Errorf("%s: not listed in MANIFEST.MF", name)
+		}
+		h, want, ok := findDigest(attrs, "")
+		if !ok {
+			return fmt.Errorf("%s: no known digest attribute", name)
+		}
+		if got := base64sum(h, string(section)); got != want {
+			return fmt.Errorf("%s: %s mismatch: has %s, calculated from MANIFEST.MF section %s", name, digestAttrs[h], want, got)
+		}
+	}
+	return nil
+}
+
+// findDigest looks in attrs for a digest attribute of one of the supported
+// hash functions, with name ending with suffix (e.g. SHA-256-Digest-Manifest
+// for suffix -Manifest), and returns the hash function and base64-encoded
+// digest value. If there are digests of multiple hash functions, the
+// strongest one is returned.
+func findDigest(attrs attributes, suffix string) (crypto.Hash, string, bool) {
+	for _, h := range []crypto.Hash{crypto.SHA512, crypto.SHA256, crypto.SHA1} {
+		if digest, ok := attrs.Get(digestAttrs[h] + suffix); ok {
+			return h, digest, true
+		}
+	}
+	return 0, "", false
+}
+
+// splitManifestSections splits raw manifest contents into the main section
+// and per-entry sections keyed by name, each including its terminating empty
+// line, as they are digested in signature files.
+func splitManifestSections(raw []byte) (mainSection []byte, sections map[string][]byte, err error) {
+	sections = map[string][]byte{}
+	start := 0
+	for start < len(raw) {
+		end := len(raw)
+		for i := start; i < len(raw); {
+			n := bytes.IndexByte(raw[i:], '\n')
+			if n == -1 {
+				break
+			}
+			line := raw[i : i+n+1]
+			i += n + 1
+			if string(line) == "\n" || string(line) == "\r\n" {
+				end = i
+				break
+			}
+		}
+		section := raw[start:end]
+		if start == 0 {
+			mainSection = section
+		} else {
+			// Parse the section alone, as preceded by an empty main section
+			m, err := parseManifest(io.MultiReader(strings.NewReader("\r\n"), bytes.NewReader(section)))
+			if err != nil {
+				return nil, nil, err
+			}
+			for name := range m {
+				if name != "" {
+					sections[name] = section
+				}
+			}
+		}
+		start = end
+	}
+	return mainSection, sections, nil
+}
+
+// printSignerTable prints details of signers as a table.
+func printSignerTable(w io.Writer, signers []v1Signer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSERIAL\tSUBJECT\tISSUER\tDIGEST\tSIGNATURE\tSHA-256")
+	for _, s := range signers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.file, s.cert.SerialNumber, s.cert.Subject, s.cert.Issuer,
+			oidName(s.digestOID), oidName(s.sigOID), fingerprint(s.cert))
+	}
+	return tw.Flush()
+}
+
+// oidNames are names of algorithm identifiers which can be found in PKCS#7
+// signatures of .apk files.
+var oidNames = map[string]string{
+	pkcs7.OIDDigestAlgorithmSHA1.String():          "SHA-1",
+	pkcs7.OIDDigestAlgorithmSHA256.String():        "SHA-256",
+	pkcs7.OIDDigestAlgorithmSHA384.String():        "SHA-384",
+	pkcs7.OIDDigestAlgorithmSHA512.String():        "SHA-512",
+	pkcs7.OIDEncryptionAlgorithmRSA.String():       "RSA",
+	pkcs7.OIDEncryptionAlgorithmRSASHA1.String():   "SHA1withRSA",
+	pkcs7.OIDEncryptionAlgorithmRSASHA256.String(): "SHA256withRSA",
+	pkcs7.OIDEncryptionAlgorithmRSASHA512.String(): "SHA512withRSA",
+	pkcs7.OIDDigestAlgorithmECDSASHA1.String():     "SHA1withECDSA",
+	pkcs7.OIDDigestAlgorithmECDSASHA256.String():   "SHA256withECDSA",
+	pkcs7.OIDDigestAlgorithmECDSASHA512.String():   "SHA512withECDSA",
+	pkcs7.OIDDigestAlgorithmDSA.String():           "DSA",
+	pkcs7.OIDDigestAlgorithmDSASHA1.String():       "SHA1withDSA",
+}
+
+// oidName returns oid in dotted form, followed by its name if known.
+func oidName(oid asn1.ObjectIdentifier) string {
+	if name, ok := oidNames[oid.String()]; ok {
+		return oid.String() + " (" + name + ")"
+	}
+	return oid.String()
+}
+
+func readZipFile(zf *zip.File) ([]byte, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", zf.Name, err)
+	}
+	defer r.Close()
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", zf.Name, err)
+	}
+	return buf, nil
+}
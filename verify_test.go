@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+func TestVerifyAPK(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	opts.Excludes = []string{"META-INF/*.stamp"}
+	longName := "res/" + strings.Repeat("a_very_long_file_name_", 5) + ".png"
+
+	for _, digest := range []string{"sha1", "sha256"} {
+		opts.Digest = digest
+		in := testZip(t, map[string]string{
+			"AndroidManifest.xml":  "<manifest/>",
+			"res/a.txt":            "hello",
+			longName:               "png",
+			"META-INF/build.stamp": "1",
+		})
+		signed := bytes.NewBuffer(nil)
+		err := SignAPK(bytes.NewReader(in), int64(len(in)), signed, cert, key, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers, err := verifyAPK(bytes.NewReader(signed.Bytes()), int64(signed.Len()))
+		if err != nil {
+			t.Fatalf("-digest %s: %s", digest, err)
+		}
+		if len(signers) != 1 || !signers[0].cert.Equal(cert) || signers[0].file != "META-INF/CERT.EC" {
+			t.Errorf("-digest %s: got signers %v, want the signing certificate in CERT.EC", digest, signers)
+		}
+	}
+
+	// Details of signers, as shown by -list-signers
+	opts.Digest = "sha256"
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>"})
+	signed := bytes.NewBuffer(nil)
+	err := SignAPK(bytes.NewReader(in), int64(len(in)), signed, cert, key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers, err := verifyAPK(bytes.NewReader(signed.Bytes()), int64(signed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := printSignerTable(buf, signers); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	wantFields := []string{"META-INF/CERT.EC", "1", "CN=basia test", "CN=basia test",
+		"2.16.840.1.101.3.4.2.1 (SHA-256)", "1.2.840.10045.4.3.2 (SHA256withECDSA)", fingerprint(cert)}
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "FILE ") {
+		t.Fatalf("got table:\n%s\nwant header and 1 signer", buf)
+	}
+	row := regexp.MustCompile(`  +`).Split(lines[1], -1)
+	if !reflect.DeepEqual(row, wantFields) {
+		t.Errorf("got signer row %q, want %q", row, wantFields)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(entries map[string]string)
+		wantErr string
+	}{{
+		"modified entry",
+		func(e map[string]string) { e["res/a.txt"] = "hellO" },
+		"res/a.txt: SHA-256-Digest mismatch",
+	}, {
+		"added entry",
+		func(e map[string]string) { e["classes.dex"] = "evil" },
+		"classes.dex: not listed in MANIFEST.MF",
+	}, {
+		"removed entry",
+		func(e map[string]string) { delete(e, "res/a.txt") },
+		"res/a.txt: listed in MANIFEST.MF but not found",
+	}, {
+		"modified MANIFEST.MF",
+		func(e map[string]string) {
+			e["META-INF/MANIFEST.MF"] = strings.Replace(e["META-INF/MANIFEST.MF"], "Built-By", "Built-by", 1)
+		},
+		"META-INF/CERT.SF: SHA-256-Digest-Manifest mismatch",
+	}, {
+		"modified CERT.SF",
+		func(e map[string]string) { e["META-INF/CERT.SF"] += "\r\n" },
+		"META-INF/CERT.EC:",
+	}, {
+		"no signature",
+		func(e map[string]string) { delete(e, "META-INF/CERT.SF"); delete(e, "META-INF/CERT.EC") },
+		"no signature files found",
+	}}
+	for _, tt := range tests {
+		entries := signedEntries(t, cert, key)
+		tt.modify(entries)
+		apk := testZip(t, entries)
+		_, err := verifyAPK(bytes.NewReader(apk), int64(len(apk)))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// signedEntries returns contents of entries of a small .apk signed with
+// SHA-256 digests.
+func signedEntries(t *testing.T, cert *x509.Certificate, key crypto.Signer) map[string]string {
+	opts := DefaultOptions()
+	opts.Digest = "sha256"
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	zr := signTestAPK(t, in, cert, key, opts)
+	entries := map[string]string{}
+	for _, zf := range zr.File {
+		buf, err := readZipFile(zf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[zf.Name] = string(buf)
+	}
+	return entries
+}
+
+func TestSignToFileVerifyAfter(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	dir := testDir(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	defer os.RemoveAll(dir)
+	defer func(old bool) { *verifyAfter = old }(*verifyAfter)
+	*verifyAfter = true
+
+	output := filepath.Join(dir, "..", filepath.Base(dir)+".apk")
+	defer os.Remove(output)
+	err := signToFile(context.Background(), output, dir, cert, key, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(output); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSignAPKSignerName(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	opts.SignerName = "MYKEY"
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>"})
+	signed := bytes.NewBuffer(nil)
+	err := SignAPK(bytes.NewReader(in), int64(len(in)), signed, cert, key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(signed.Bytes()), int64(signed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, zf := range zr.File {
+		got = append(got, zf.Name)
+	}
+	want := []string{"META-INF/MANIFEST.MF", "META-INF/MYKEY.SF", "META-INF/MYKEY.EC", "AndroidManifest.xml"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %q, want %q", got, want)
+	}
+	signers, err := verifyAPK(bytes.NewReader(signed.Bytes()), int64(signed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 || signers[0].file != "META-INF/MYKEY.EC" {
+		t.Errorf("got signers %v, want one in META-INF/MYKEY.EC", signers)
+	}
+
+	for _, name := range []string{"", "MY KEY", "../X", "KEY.1"} {
+		if validSignerName(name) {
+			t.Errorf("validSignerName(%q) = true, want false", name)
+		}
+	}
+}
+
+func TestSignToFileStdout(t *testing.T) {
+	cert, key := testCertAndKey(t)
+	opts := DefaultOptions()
+	dir := testDir(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	defer os.RemoveAll(dir)
+
+	// A pipe, as in: basia -o - | ...
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *os.File) { os.Stdout = old }(os.Stdout)
+	os.Stdout = w
+	read := make(chan []byte)
+	go func() {
+		buf, _ := ioutil.ReadAll(r)
+		read <- buf
+	}()
+	err = signToFile(context.Background(), "-", dir, cert, key, &opts)
+	w.Close()
+	apk := <-read
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifyAPK(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSignAPKSigningTime(t *testing.T) {
+	opts := DefaultOptions()
+	cert, key, err := generateDebugKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old func() time.Time) { now = old }(now)
+	in := testZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>", "res/a.txt": "hello"})
+	// signBlock signs in with the clock set to at, returning CERT.RSA
+	signBlock := func(at time.Time) []byte {
+		now = func() time.Time { return at }
+		signed := bytes.NewBuffer(nil)
+		err := SignAPK(bytes.NewReader(in), int64(len(in)), signed, cert, key, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyAPK(bytes.NewReader(signed.Bytes()), int64(signed.Len())); err != nil {
+			t.Fatalf("-signing-time %s: %s", opts.SigningTime, err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(signed.Bytes()), int64(signed.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, zf := range zr.File {
+			if zf.Name == "META-INF/CERT.RSA" {
+				buf, err := readZipFile(zf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return buf
+			}
+		}
+		t.Fatal("no META-INF/CERT.RSA found")
+		return nil
+	}
+	signedTime := func(block []byte) (time.Time, error) {
+		var got time.Time
+		p7, err := pkcs7.Parse(block)
+		if err != nil {
+			return got, err
+		}
+		err = p7.UnmarshalSignedAttribute(pkcs7.OIDAttributeSigningTime, &got)
+		return got, err
+	}
+	t1 := cert.NotBefore.Add(time.Hour).Truncate(time.Second)
+	t2 := t1.Add(time.Hour)
+	fixed := t1.Add(30 * time.Minute).UTC()
+
+	tests := []struct {
+		signingTime string
+		want1       time.Time // signing time when signed at t1, zero if none
+		identical   bool      // whether signed at t1 and t2 is the same
+	}{
+		{"now", t1, false},
+		{fixed.Format(time.RFC3339), fixed, true},
+		{"none", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		opts.SigningTime = tt.signingTime
+		first, second := signBlock(t1), signBlock(t2)
+		got, err := signedTime(first)
+		switch {
+		case tt.want1.IsZero() && err == nil:
+			t.Errorf("-signing-time %s: got signing time %s, want none", tt.signingTime, got)
+		case !tt.want1.IsZero() && (err != nil || !got.Equal(tt.want1)):
+			t.Errorf("-signing-time %s: got signing time %s, %v; want %s", tt.signingTime, got, err, tt.want1)
+		}
+		if bytes.Equal(first, second) != tt.identical {
+			t.Errorf("-signing-time %s: CERT.RSA signed at different times identical: %v, want %v", tt.signingTime, !tt.identical, tt.identical)
+		}
+	}
+}
+
+func TestVerifyAPKLowercaseMetaInf(t *testing.T) {
+	zr := signTestZip(t, map[string]string{"AndroidManifest.xml": "<manifest/>"})
+	entries := map[string]string{}
+	for _, zf := range zr.File {
+		buf, err := readZipFile(zf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := zf.Name
+		if strings.HasPrefix(name, "META-INF/") {
+			name = strings.ToLower(name)
+		}
+		entries[name] = string(buf)
+	}
+	renamed := testZip(t, entries)
+	signers, err := verifyAPK(bytes.NewReader(renamed), int64(len(renamed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 || signers[0].file != "meta-inf/cert.ec" {
+		t.Errorf("got signers %v, want one in meta-inf/cert.ec", signers)
+	}
+	schemes, err := detectSchemes(bytes.NewReader(renamed), int64(len(renamed)))
+	if err != nil || !schemes.v1 {
+		t.Errorf("got schemes %+v, %v; want v1", schemes, err)
+	}
+}